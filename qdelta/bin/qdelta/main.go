@@ -5,95 +5,538 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
 
 	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/digest"
+	"github.com/daniel-nichter/lab/qdelta/genlog"
+	"github.com/daniel-nichter/lab/qdelta/pcap"
 	"github.com/daniel-nichter/lab/qdelta/report"
 	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	gomysql "github.com/go-mysql/slowlog"
 )
 
 var (
-	flagFile     string
-	flagBase     string
-	flagComp     string
-	flagMinDelta float64
+	flagFile         string
+	flagBaseFile     string
+	flagCompFile     string
+	flagBase         string
+	flagComp         string
+	flagMinDelta     float64
+	flagWorkers      int
+	flagSeries       string
+	flagBucket       time.Duration
+	flagSeriesBy     string
+	flagOutput       string
+	flagBaseResult   string
+	flagCompResult   string
+	flagSaveBase     string
+	flagSaveComp     string
+	flagSignificance float64
+	flagSimilarity   float64
+	flagRollup       string
+	flagMetrics      string
+	flagLimit        int
+	flagColumns      string
+	flagWidth        int
+	flagColor        string
+	flagUser         string
+	flagHost         string
+	flagDb           string
+	flagIgnoreUser   string
+	flagIgnoreHost   string
+	flagIgnoreDb     string
+	flagGroupBy      string
+	flagTz           string
+	flagOutlierTime  float64
+	flagBaseRate     float64
+	flagCompRate     float64
+	flagBaseDigest   string
+	flagCompDigest   string
+	flagFormat       string
+	flagPort         int
+
+	location *time.Location // -tz
+	reported []string       // -metrics
+	layout   report.Layout  // -output text or markdown
 )
 
-func init() {
-	runtime.GOMAXPROCS(2)
+// commands are subcommands like "qdelta watch", which have their own flags.
+var commands = map[string]func(args []string){
+	"metrics": metrics,
+	"serve":   serve,
+	"watch":   watch,
+}
 
+func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 	log.SetOutput(os.Stderr)
 
-	flag.StringVar(&flagFile, "file", "", "Slow log file")
-	flag.StringVar(&flagBase, "base", "", "Baseline time range [since, until]")
-	flag.StringVar(&flagComp, "comp", "", "Comparison time range [since, until]")
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		return // main runs the command
+	}
+
+	flag.StringVar(&flagFile, "file", "", "Slow log files: comma-separated, globs, .gz, .zst, or - for stdin (or as arguments)")
+	flag.StringVar(&flagBaseFile, "base-file", "", "Baseline slow log file (default: -file)")
+	flag.StringVar(&flagCompFile, "comp-file", "", "Comparison slow log file (default: -file)")
+	flag.StringVar(&flagBase, "base", "", "Baseline time range [since, until] (default: whole file)")
+	flag.StringVar(&flagComp, "comp", "", "Comparison time range [since, until] (default: whole file)")
 	flag.Float64Var(&flagMinDelta, "min-delta", 1, "Minimum delta")
+	flag.Float64Var(&flagSignificance, "significance", 0, "Minimum delta confidence (0-1), e.g. 0.95 to hide noise. Per-query metric (avg, p95, rows, etc.) confidence is a rough normal approximation from the median and p95, too high for skewed values like Query_time; see README")
+	flag.Float64Var(&flagSimilarity, "similarity", delta.DEFAULT_SIMILARITY, "Minimum fingerprint similarity (0-1) of a missing and new query to report them as one changed query, or 0 to disable")
+	flag.StringVar(&flagMetrics, "metrics", "", "Metrics to report, comma-separated (default: all): "+strings.Join(delta.OrderBy, ", "))
+	flag.StringVar(&flagRollup, "rollup", "", "Also report deltas rolled up by table, type (statement type), and/or db: comma-separated")
+	flag.IntVar(&flagWorkers, "workers", runtime.NumCPU(), "Number of fingerprint workers")
+	flag.StringVar(&flagSeries, "series", "", "Time series range [since, until] split into -bucket")
+	flag.DurationVar(&flagBucket, "bucket", 5*time.Minute, "Time series bucket duration")
+	flag.StringVar(&flagSeriesBy, "series-by", "jump", "Order time series changes by jump or slope")
+	flag.StringVar(&flagOutput, "output", "text", "Output format: text, markdown, json, or csv")
+	flag.IntVar(&flagLimit, "limit", 0, "Print at most this many queries per table (default: all above -min-delta)")
+	flag.StringVar(&flagColumns, "columns", "", "Delta table columns, comma-separated (default: all): "+strings.Join(report.COLUMNS, ", "))
+	flag.IntVar(&flagWidth, "width", 0, "Truncate fingerprints to this many characters (default: no truncation)")
+	flag.StringVar(&flagColor, "color", "auto", "Color delta increases and decreases: auto (if stdout is a terminal), always, or never")
+	flag.StringVar(&flagBaseResult, "base-result", "", "Load baseline result saved by -save-base instead of processing a slow log")
+	flag.StringVar(&flagCompResult, "comp-result", "", "Load comparison result saved by -save-comp instead of processing a slow log")
+	flag.StringVar(&flagBaseDigest, "base-digest", "", "Baseline from two performance_schema digest snapshots: before,after (instead of a slow log)")
+	flag.StringVar(&flagCompDigest, "comp-digest", "", "Comparison from two performance_schema digest snapshots: before,after (instead of a slow log)")
+	flag.StringVar(&flagSaveBase, "save-base", "", "Save baseline result to file")
+	flag.StringVar(&flagSaveComp, "save-comp", "", "Save comparison result to file")
+
+	flag.StringVar(&flagUser, "user", "", "Only queries from users matching this regex")
+	flag.StringVar(&flagHost, "host", "", "Only queries from hosts matching this regex")
+	flag.StringVar(&flagDb, "db", "", "Only queries in databases matching this regex")
+	flag.StringVar(&flagIgnoreUser, "ignore-user", "", "Ignore queries from users matching this regex")
+	flag.StringVar(&flagIgnoreHost, "ignore-host", "", "Ignore queries from hosts matching this regex")
+	flag.StringVar(&flagIgnoreDb, "ignore-db", "", "Ignore queries in databases matching this regex")
+	flag.StringVar(&flagGroupBy, "group-by", "", "Break down each query by user, host, or db")
+	flag.Float64Var(&flagBaseRate, "base-rate", 0, "Baseline sampling rate, e.g. 10 if 1 of 10 queries was logged (default: Log_slow_rate_limit in slow log)")
+	flag.Float64Var(&flagCompRate, "comp-rate", 0, "Comparison sampling rate (default: Log_slow_rate_limit in slow log)")
+	flag.StringVar(&flagFormat, "format", "slow", "Input file format: slow (slow log), general (general log), or pcap (tcpdump -w)")
+	flag.IntVar(&flagPort, "port", pcap.DEFAULT_PORT, "MySQL server port for -format pcap")
+	sharedFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	// We don't accept any possitional arguments
+	// Positional arguments are slow log files, like -file
 	if len(flag.Args()) != 0 {
-		flag.Usage()
-		os.Exit(1)
+		if flagFile != "" {
+			log.Fatal("-file and slow log file arguments are mutually exclusive")
+		}
+		flagFile = strings.Join(flag.Args(), ",")
+	}
+
+	switch flagOutput {
+	case "text", "markdown", "json", "csv":
+	default:
+		log.Fatalf("invalid -output: %s: expected text, markdown, json, or csv", flagOutput)
+	}
+
+	if flagLimit < 0 || flagWidth < 0 {
+		log.Fatal("-limit and -width must be zero or greater")
+	}
+	layout = report.Layout{
+		Limit:    flagLimit,
+		Width:    flagWidth,
+		Markdown: flagOutput == "markdown",
+	}
+	if flagColumns != "" {
+		columns, err := report.ParseColumns(flagColumns)
+		if err != nil {
+			log.Fatalf("invalid -columns: %s", err)
+		}
+		layout.Columns = columns
+	}
+	switch flagColor {
+	case "auto":
+		layout.Color = flagOutput == "text" && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+	case "always":
+		layout.Color = flagOutput == "text"
+	case "never":
+	default:
+		log.Fatalf("invalid -color: %s: expected auto, always, or never", flagColor)
+	}
+
+	switch flagFormat {
+	case "slow", "general", "pcap":
+	default:
+		log.Fatalf("invalid -format: %s: expected slow, general, or pcap", flagFormat)
+	}
+
+	parseSharedFlags()
+
+	reported = delta.OrderBy
+	if flagMetrics != "" {
+		metrics, err := delta.ParseMetrics(flagMetrics)
+		if err != nil {
+			log.Fatalf("invalid -metrics: %s", err)
+		}
+		reported = make([]string, len(metrics))
+		for i, mt := range metrics {
+			reported[i] = mt.Name
+		}
+	}
+
+	switch flagGroupBy {
+	case "", "user", "host", "db":
+	default:
+		log.Fatalf("invalid -group-by: %s: expected user, host, or db", flagGroupBy)
+	}
+
+	if flagRollup != "" {
+		if flagOutput != "text" && flagOutput != "markdown" {
+			log.Fatal("-rollup only supports -output text or markdown")
+		}
+		for _, level := range strings.Split(flagRollup, ",") {
+			if !validRollup(level) {
+				log.Fatalf("invalid -rollup: %s: expected %s", level, strings.Join(delta.ROLLUPS, ", "))
+			}
+		}
+	}
+
+	if flagSeries != "" {
+		if flagOutput != "text" {
+			log.Fatal("-series only supports -output text")
+		}
+		if flagFile == "" {
+			log.Fatal("-file must be specified with -series")
+		}
+		if flagBucket <= 0 {
+			log.Fatal("-bucket must be greater than zero")
+		}
+		if flagSeriesBy != "jump" && flagSeriesBy != "slope" {
+			log.Fatalf("invalid -series-by: %s: expected jump or slope", flagSeriesBy)
+		}
+		return
+	}
+
+	// -base-file and -comp-file default to -file, so the usual case is
+	// comparing two ranges of one file. A saved result or digest snapshots
+	// replace the file.
+	if flagBaseFile == "" && flagBaseResult == "" && flagBaseDigest == "" {
+		flagBaseFile = flagFile
+	}
+	if flagCompFile == "" && flagCompResult == "" && flagCompDigest == "" {
+		flagCompFile = flagFile
+	}
+	haveBase := flagBaseFile != "" || flagBaseResult != "" || flagBaseDigest != ""
+	haveComp := flagCompFile != "" || flagCompResult != "" || flagCompDigest != ""
+	if !haveBase && !haveComp {
+		log.Fatal("-file, or -base-file/-base-result/-base-digest and -comp-file/-comp-result/-comp-digest, must be specified")
+	}
+	if !haveBase || !haveComp {
+		// Only saving one result is ok, e.g. a baseline to compare to later
+		if (haveBase && flagSaveBase == "") || (haveComp && flagSaveComp == "") {
+			log.Fatal("-file, or -base-file/-base-result/-base-digest and -comp-file/-comp-result/-comp-digest, must be specified")
+		}
+	}
+	if flagBaseFile != "" && flagBaseFile == flagCompFile && (flagBase == "" || flagComp == "") {
+		log.Fatal("-base and -comp time ranges must be specified when comparing one file")
 	}
 }
 
-func main() {
-	base, err := Parse(flagFile, flagBase)
+// sharedFlags adds the flags that every command has to fs.
+func sharedFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flagTz, "tz", "UTC", "Time zone of time ranges and slow log timestamps without one (MySQL server time zone), e.g. Local or America/New_York")
+	fs.Float64Var(&flagOutlierTime, "outlier-time", 10, "Queries slower than this many seconds are always logged, not sampled (slow_query_log_always_write_time)")
+}
+
+// parseSharedFlags validates the flags added by sharedFlags after they're parsed.
+func parseSharedFlags() {
+	var err error
+	location, err = time.LoadLocation(flagTz)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("invalid -tz: %s", err)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		commands[os.Args[1]](os.Args[2:])
+		return
+	}
+
+	if flagSeries != "" {
+		series()
+		return
 	}
-	log.Printf("base duration: %s", base.End.Sub(base.Begin).String())
 
-	comp, err := Parse(flagFile, flagComp)
+	base, comp, err := Results()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if flagBaseRate > 0 {
+		base.SampleRate = flagBaseRate
+		base.ClassSampleRate = nil
+	}
+	if flagCompRate > 0 {
+		comp.SampleRate = flagCompRate
+		comp.ClassSampleRate = nil
+	}
+	if base.Rate() != comp.Rate() {
+		log.Printf("base sampling rate %.1f, comp sampling rate %.1f", base.Rate(), comp.Rate())
+	}
+	if flagSaveBase != "" && flagBaseResult == "" {
+		if err := slowlog.Save(flagSaveBase, base); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("saved base result in %s", flagSaveBase)
+	}
+	if flagSaveComp != "" && flagCompResult == "" {
+		if err := slowlog.Save(flagSaveComp, comp); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("saved comp result in %s", flagSaveComp)
+	}
+	if (flagBaseFile == "" && flagBaseResult == "" && flagBaseDigest == "") || (flagCompFile == "" && flagCompResult == "" && flagCompDigest == "") {
+		return // only saving a result
+	}
+
+	log.Printf("base duration: %s", base.End.Sub(base.Begin).String())
 	log.Printf("comp duration: %s", comp.End.Sub(comp.Begin).String())
 
 	metrics := delta.Merge(base, comp)
+	var matches []delta.Match
+	if flagSimilarity > 0 {
+		matches = delta.MatchChanged(metrics, base, comp, flagSimilarity)
+	}
+
+	if flagOutput == "json" || flagOutput == "csv" {
+		// Every row, ordered by QPS delta
+		deltas := delta.Delta(metrics, "qps")
+		rows := report.Rows(deltas, report.NewRealIter("qps", base, comp, metrics), reported)
+		if flagOutput == "json" {
+			err = report.PrintJSON(os.Stdout, rows)
+		} else {
+			err = report.PrintCSV(os.Stdout, rows, reported)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(matches) > 0 {
+		title("changed")
+		report.PrintChanged(matches, base, comp, layout)
+		fmt.Println("")
+	}
+
+	// Which queries caused the global change, then each metric's deltas
+	for _, metric := range delta.ContributionMetrics() {
+		global, contribs, err := delta.Contributions(metrics, metric)
+		if err != nil {
+			log.Fatal(err)
+		}
+		title(metric + " contribution")
+		report.PrintContributions(global, contribs, report.NewRealIter(metric, base, comp, metrics), flagMinDelta, layout)
+		fmt.Println("")
+	}
 
-	for _, orderBy := range []string{"qps", "load", "count", "exectime"} {
+	for _, orderBy := range reported {
 		deltas := delta.Delta(metrics, orderBy)
 		iter := report.NewRealIter(orderBy, base, comp, metrics)
 
-		fmt.Printf("# %s delta\n", orderBy)
-		report.Print(deltas, iter, flagMinDelta)
+		title(orderBy + " delta")
+		report.Print(deltas, iter, flagMinDelta, flagSignificance, layout)
 		fmt.Println("")
 	}
+
+	// Same deltas for tables, statement types, and databases
+	if flagRollup == "" {
+		return
+	}
+	for _, level := range strings.Split(flagRollup, ",") {
+		rolledBase, err := delta.Rollup(base, level)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rolledComp, err := delta.Rollup(comp, level)
+		if err != nil {
+			log.Fatal(err)
+		}
+		metrics := delta.Merge(rolledBase, rolledComp)
+		for _, orderBy := range delta.ROLLUP_ORDER_BY {
+			deltas := delta.Delta(metrics, orderBy)
+			iter := report.NewRealIter(orderBy, rolledBase, rolledComp, metrics)
+
+			title(level + " " + orderBy + " delta")
+			report.Print(deltas, iter, flagMinDelta, flagSignificance, layout)
+			fmt.Println("")
+		}
+	}
+}
+
+// title prints the title of a table: a comment in text output, or a heading
+// in Markdown output.
+func title(t string) {
+	if layout.Markdown {
+		fmt.Printf("### %s\n\n", t)
+		return
+	}
+	fmt.Printf("# %s\n", t)
 }
 
-func Parse(file, timeRange string) (slowlog.Result, error) {
-	var res slowlog.Result
+// isTerminal returns true if the file is a terminal (character device), not
+// a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
-	t := strings.Split(timeRange, "/")
-	if len(t) != 2 {
-		return res, fmt.Errorf("invalid time range: '%s': split returned %d timestamps, expected 2",
-			timeRange, len(t))
+func validRollup(level string) bool {
+	for _, r := range delta.ROLLUPS {
+		if level == r {
+			return true
+		}
 	}
-	since, err := time.Parse("2006-01-02T15:04:05", t[0])
+	return false
+}
+
+// Results returns the base and comp results, loading saved results, diffing
+// digest snapshots, or processing slow logs. Each slow log is processed only once: both intervals
+// in one pass if they're in the same file, else each interval in its own file.
+// A result is zero if it has neither a saved result nor a slow log.
+func Results() (slowlog.Result, slowlog.Result, error) {
+	var base, comp slowlog.Result
+
+	baseInterval, err := slowlog.ParseInterval(flagBase, location)
 	if err != nil {
-		return res, fmt.Errorf("invalid timestamp: '%s': %s", t[0], err)
+		return base, comp, err
 	}
-	until, err := time.Parse("2006-01-02T15:04:05", t[1])
+	compInterval, err := slowlog.ParseInterval(flagComp, location)
 	if err != nil {
-		return res, fmt.Errorf("invalid timestamp: '%s': %s", t[0], err)
+		return base, comp, err
 	}
 
-	i := slowlog.Interval{
-		File:  flagFile,
-		Since: since,
-		Until: until,
+	if flagBaseFile != "" && flagBaseFile == flagCompFile {
+		res, err := Process(flagBaseFile, baseInterval, compInterval)
+		if err != nil {
+			return base, comp, err
+		}
+		return res[0], res[1], nil
 	}
-	p := slowlog.NewProcessor(time.Duration(0), 10)
 
-	log.Printf("Processing %s since %s until %s...\n", file, since, until)
-	res, err = p.Process(i)
+	if flagBaseResult != "" {
+		log.Printf("Loading base result from %s...", flagBaseResult)
+		base, err = slowlog.Load(flagBaseResult)
+	} else if flagBaseDigest != "" {
+		base, err = Digest(flagBaseDigest)
+	} else if flagBaseFile != "" {
+		var res []slowlog.Result
+		res, err = Process(flagBaseFile, baseInterval)
+		if err == nil {
+			base = res[0]
+		}
+	}
 	if err != nil {
-		return res, err
+		return base, comp, err
+	}
+
+	if flagCompResult != "" {
+		log.Printf("Loading comp result from %s...", flagCompResult)
+		comp, err = slowlog.Load(flagCompResult)
+	} else if flagCompDigest != "" {
+		comp, err = Digest(flagCompDigest)
+	} else if flagCompFile != "" {
+		var res []slowlog.Result
+		res, err = Process(flagCompFile, compInterval)
+		if err == nil {
+			comp = res[0]
+		}
+	}
+	return base, comp, err
+}
+
+func Process(file string, intervals ...slowlog.Interval) ([]slowlog.Result, error) {
+	p, err := NewProcessor()
+	if err != nil {
+		return nil, err
+	}
+	files, err := Files(file)
+	if err != nil {
+		return nil, err
+	}
+	if flagFormat == "pcap" && len(files) > 1 {
+		return nil, fmt.Errorf("-format pcap reads only one file: merge captures with mergecap")
+	}
+	for _, i := range intervals {
+		log.Printf("Processing %s since %s until %s...\n", file, i.Since, i.Until)
+	}
+	return p.ProcessFiles(files, intervals)
+}
+
+// Digest returns the difference between two digest snapshots: before,after.
+func Digest(snapshots string) (slowlog.Result, error) {
+	files := strings.Split(snapshots, ",")
+	if len(files) != 2 {
+		return slowlog.Result{}, fmt.Errorf("invalid digest snapshots: %s: expected before,after", snapshots)
+	}
+	log.Printf("Diffing digest snapshots %s and %s...", files[0], files[1])
+	before, err := digest.Read(files[0], location)
+	if err != nil {
+		return slowlog.Result{}, err
+	}
+	after, err := digest.Read(files[1], location)
+	if err != nil {
+		return slowlog.Result{}, err
+	}
+	return digest.Diff(before, after)
+}
+
+// Files returns the slow log files in a comma-separated list of files and
+// globs, like slow.log.*.gz,slow.log. Each glob must match at least one file.
+func Files(list string) ([]string, error) {
+	files := []string{}
+	for _, f := range strings.Split(list, ",") {
+		if f == slowlog.STDIN || !strings.ContainsAny(f, "*?[") {
+			files = append(files, f)
+			continue
+		}
+		matches, err := filepath.Glob(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob: %s: %s", f, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", f)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// NewProcessor returns a slow log processor with the -workers, -tz, filter,
+// -group-by, and -format options.
+func NewProcessor() (*slowlog.Processor, error) {
+	p := slowlog.NewProcessor(time.Duration(0), flagOutlierTime, flagWorkers)
+	p.Location = location
+	for _, f := range []struct {
+		re  string
+		dst **regexp.Regexp
+	}{
+		{flagUser, &p.Filter.User},
+		{flagHost, &p.Filter.Host},
+		{flagDb, &p.Filter.Db},
+		{flagIgnoreUser, &p.Filter.IgnoreUser},
+		{flagIgnoreHost, &p.Filter.IgnoreHost},
+		{flagIgnoreDb, &p.Filter.IgnoreDb},
+	} {
+		r, err := slowlog.FilterRegexp(f.re)
+		if err != nil {
+			return nil, err
+		}
+		*f.dst = r
+	}
+	p.GroupBy = flagGroupBy
+	switch flagFormat {
+	case "general":
+		p.NewParser = func(fd *os.File) gomysql.Parser { return genlog.NewParser(fd) }
+	case "pcap":
+		p.NewParser = func(fd *os.File) gomysql.Parser { return pcap.NewParser(fd, flagPort) }
+		p.Unordered = true
 	}
-	return res, nil
+	return p, nil
 }
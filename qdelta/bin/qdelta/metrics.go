@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/openmetrics"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// metrics writes per-query metrics as OpenMetrics text, once for a time range
+// of a slow log, or continuously on /metrics while following a slow log.
+func metrics(args []string) {
+	var (
+		file           string
+		timeRange      string
+		out            string
+		addr           string
+		bucket         time.Duration
+		poll           time.Duration
+		fingerprintLen int
+		workers        int
+	)
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	fs.StringVar(&file, "file", "", "Slow log file")
+	fs.StringVar(&timeRange, "range", "", "Time range [since, until] (default: whole file)")
+	fs.StringVar(&out, "out", "", "Write metrics to file (default: stdout)")
+	fs.StringVar(&addr, "addr", "", "Follow -file and serve metrics on this address at /metrics")
+	fs.DurationVar(&bucket, "bucket", time.Minute, "How often to update metrics with -addr")
+	fs.DurationVar(&poll, "poll", time.Second, "How often to check the slow log for new events with -addr")
+	fs.IntVar(&fingerprintLen, "fingerprint-len", 50, "Truncate fingerprint labels to this many characters (0 = no limit)")
+	fs.IntVar(&workers, "workers", runtime.NumCPU(), "Number of fingerprint workers")
+	sharedFlags(fs)
+	fs.Parse(args)
+
+	if len(fs.Args()) != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	parseSharedFlags()
+	if file == "" {
+		log.Fatal("-file must be specified")
+	}
+	if addr != "" && (timeRange != "" || out != "") {
+		log.Fatal("-range and -out are not used with -addr")
+	}
+	if addr != "" && bucket <= 0 {
+		log.Fatal("-bucket must be greater than zero")
+	}
+
+	p := slowlog.NewProcessor(time.Duration(0), flagOutlierTime, workers)
+	p.Location = location
+
+	if addr != "" {
+		f := slowlog.NewFollower(file, poll)
+		if err := f.Start(); err != nil {
+			log.Fatal(err)
+		}
+		e := openmetrics.NewExporter(fingerprintLen)
+		go func() {
+			for res := range p.Stream(f.Events(), bucket) {
+				e.Add(res)
+			}
+		}()
+		http.Handle("/metrics", e)
+		log.Printf("Following %s, listening on http://%s/metrics", file, addr)
+		log.Fatal(http.ListenAndServe(addr, nil))
+	}
+
+	i, err := slowlog.ParseInterval(timeRange, location)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Processing %s since %s until %s...\n", file, i.Since, i.Until)
+	res, err := p.Process(file, []slowlog.Interval{i})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := os.Stdout
+	if out != "" {
+		w, err = os.Create(out)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := openmetrics.Write(w, res[0], res[0], fingerprintLen); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/report"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// series splits the -series time range into -bucket intervals, processes
+// them in one pass, and reports which queries changed most across them.
+func series() {
+	r, err := slowlog.ParseInterval(flagSeries, location)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r.Since.IsZero() || !r.Since.Before(r.Until) {
+		log.Fatalf("invalid -series time range: %s", flagSeries)
+	}
+
+	// Until is inclusive, so end each bucket just before the next begins
+	buckets := []slowlog.Interval{}
+	for since := r.Since; since.Before(r.Until); since = since.Add(flagBucket) {
+		buckets = append(buckets, slowlog.Interval{
+			Since: since,
+			Until: since.Add(flagBucket - 1),
+		})
+	}
+	log.Printf("%d buckets of %s", len(buckets), flagBucket)
+
+	p, err := NewProcessor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := Files(flagFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Processing %s since %s until %s...\n", flagFile, r.Since, r.Until)
+	res, err := p.ProcessFiles(files, buckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := delta.MergeSeries(res, flagBucket)
+	for _, metric := range reported {
+		if mt, _ := delta.Lookup(metric); mt.Of != "" {
+			continue // relative deltas (avg-rel) aren't a value per bucket
+		}
+		changes := delta.SeriesDelta(s, metric, flagSeriesBy)
+		fmt.Printf("# %s %s\n", metric, flagSeriesBy)
+		report.PrintSeries(changes, metric, flagSeriesBy, buckets, res, flagMinDelta)
+		fmt.Println("")
+	}
+}
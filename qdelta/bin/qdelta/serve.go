@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/server"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// serve serves deltas of slow logs and saved results over HTTP. Slow logs are
+// processed on demand for the time ranges that clients request.
+func serve(args []string) {
+	var (
+		files   string
+		results string
+		addr    string
+		workers int
+	)
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(&files, "file", "", "Comma-separated slow log files")
+	fs.StringVar(&results, "result", "", "Comma-separated results saved by -save-base or -save-comp")
+	fs.StringVar(&addr, "addr", "localhost:8080", "Address to listen on")
+	fs.IntVar(&workers, "workers", runtime.NumCPU(), "Number of fingerprint workers")
+	sharedFlags(fs)
+	fs.Parse(args)
+
+	if len(fs.Args()) != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	parseSharedFlags()
+	if files == "" && results == "" {
+		log.Fatal("-file or -result must be specified")
+	}
+
+	p := slowlog.NewProcessor(time.Duration(0), flagOutlierTime, workers)
+	p.Location = location
+	s, err := server.New(p, split(files), split(results))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Listening on http://%s/", addr)
+	log.Fatal(http.ListenAndServe(addr, s.Handler()))
+}
+
+// split splits a comma-separated list, returning nil if it's empty.
+func split(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/report"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// watch follows a live slow log and compares the last -window to the
+// -baseline before it every -bucket, alerting when a query's QPS or load
+// delta crosses a threshold.
+func watch(args []string) {
+	var (
+		file          string
+		bucket        time.Duration
+		window        time.Duration
+		baseline      time.Duration
+		poll          time.Duration
+		qpsThreshold  float64
+		loadThreshold float64
+		significance  float64
+		similarity    float64
+		output        string
+	)
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.StringVar(&file, "file", "", "Slow log file to follow")
+	fs.DurationVar(&bucket, "bucket", time.Minute, "How often to compare windows")
+	fs.DurationVar(&window, "window", 5*time.Minute, "Comparison window (most recent)")
+	fs.DurationVar(&baseline, "baseline", time.Hour, "Baseline window (before comparison window)")
+	fs.DurationVar(&poll, "poll", time.Second, "How often to check the slow log for new events")
+	fs.Float64Var(&qpsThreshold, "qps-threshold", 1, "Alert on QPS delta >= this")
+	fs.Float64Var(&loadThreshold, "load-threshold", 0.5, "Alert on load delta >= this")
+	fs.Float64Var(&similarity, "similarity", delta.DEFAULT_SIMILARITY, "Minimum fingerprint similarity (0-1) of a missing and new query to report them as one changed query, or 0 to disable")
+	fs.Float64Var(&significance, "significance", 0, "Minimum delta confidence (0-1) to alert. Load confidence includes a rough normal approximation of Query_time, too high for skewed values; see README")
+	fs.StringVar(&output, "output", "text", "Output format: text or json")
+	sharedFlags(fs)
+	fs.Parse(args)
+
+	if len(fs.Args()) != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	parseSharedFlags()
+	if file == "" {
+		log.Fatal("-file must be specified")
+	}
+	if bucket <= 0 || window < bucket || baseline < bucket {
+		log.Fatal("-bucket must be greater than zero, and -window and -baseline at least -bucket")
+	}
+	if window%bucket != 0 || baseline%bucket != 0 {
+		log.Fatal("-window and -baseline must be multiples of -bucket")
+	}
+	if output != "text" && output != "json" {
+		log.Fatalf("invalid -output: %s: expected text or json", output)
+	}
+
+	f := slowlog.NewFollower(file, poll)
+	if err := f.Start(); err != nil {
+		log.Fatal(err)
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		<-sigChan
+		f.Stop()
+	}()
+	log.Printf("Following %s...", file)
+
+	// Keep the last baseline+window buckets. When full, the oldest are the
+	// baseline and the newest are the comparison window.
+	nBase := int(baseline / bucket)
+	nComp := int(window / bucket)
+	buckets := make([]slowlog.Result, 0, nBase+nComp+1)
+
+	alerting := map[string]bool{} // ids that crossed a threshold last time
+
+	p := slowlog.NewProcessor(time.Duration(0), flagOutlierTime, 1)
+	p.Location = location
+	for res := range p.Stream(f.Events(), bucket) {
+		buckets = append(buckets, res)
+		if len(buckets) > nBase+nComp {
+			buckets = buckets[1:]
+		}
+		if len(buckets) < nBase+nComp {
+			log.Printf("warming up: %d of %d buckets", len(buckets), nBase+nComp)
+			continue
+		}
+
+		base := slowlog.Combine(buckets[:nBase]...)
+		comp := slowlog.Combine(buckets[nBase:]...)
+		metrics := delta.Merge(base, comp)
+		if similarity > 0 {
+			delta.MatchChanged(metrics, base, comp, similarity)
+		}
+
+		// Alert only on queries that newly crossed a threshold, else the same
+		// queries are reported every bucket until they're back to normal.
+		crossed := map[string]bool{}
+		alerts := []delta.Metrics{}
+		for _, d := range delta.Delta(metrics, "qps") {
+			c := metrics[d.Id].Confidence
+			qps := math.Abs(d.QPS) >= qpsThreshold && c.QPS >= significance
+			load := math.Abs(d.Load) >= loadThreshold && c.Load >= significance
+			if !qps && !load {
+				continue
+			}
+			crossed[d.Id] = true
+			if !alerting[d.Id] {
+				alerts = append(alerts, d)
+			}
+		}
+		alerting = crossed
+		if len(alerts) == 0 {
+			continue
+		}
+
+		if output == "json" {
+			rows := report.Rows(alerts, report.NewRealIter("qps", base, comp, metrics), nil)
+			if err := report.PrintJSON(os.Stdout, rows); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		fmt.Printf("# %s to %s vs. %s to %s\n",
+			comp.Begin.Format(time.RFC3339), comp.End.Format(time.RFC3339),
+			base.Begin.Format(time.RFC3339), base.End.Format(time.RFC3339))
+		for _, orderBy := range []string{"qps", "load"} {
+			fmt.Printf("# %s delta\n", orderBy)
+			report.Print(delta.Delta(only(metrics, alerts), orderBy), report.NewRealIter(orderBy, base, comp, metrics), 0, significance, report.Layout{})
+			fmt.Println("")
+		}
+	}
+}
+
+// only returns the metrics of the deltas.
+func only(metrics map[string]delta.Result, deltas []delta.Metrics) map[string]delta.Result {
+	m := make(map[string]delta.Result, len(deltas))
+	for _, d := range deltas {
+		m[d.Id] = metrics[d.Id]
+	}
+	return m
+}
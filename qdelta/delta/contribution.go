@@ -0,0 +1,74 @@
+package delta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Contribution is how much one query contributed to the change of a global
+// metric: its delta as a fraction of the global delta (Pct). The Pct of every
+// query, including new and missing queries, sums to 1. A query that changed
+// the other way, e.g. decreased when the global metric increased, has a
+// negative Pct.
+type Contribution struct {
+	Id    string
+	Base  float64
+	Comp  float64
+	Delta float64 // Comp - Base
+	Pct   float64 // Delta / global Delta, or zero if the global metric didn't change
+}
+
+// ContributionMetrics returns the names of the Sum metrics in OrderBy order,
+// which Contributions can break down by query.
+func ContributionMetrics() []string {
+	names := []string{}
+	for _, mt := range Registered() {
+		if mt.Sum {
+			names = append(names, mt.Name)
+		}
+	}
+	return names
+}
+
+// Contributions returns the global contribution (no Id) and every query's
+// contribution to the delta of the metric, which must be a registered Sum
+// metric, ordered by Pct, largest first: the queries that caused most of the
+// change.
+func Contributions(metrics map[string]Result, metric string) (Contribution, []Contribution, error) {
+	mt, ok := Lookup(metric)
+	if !ok || !mt.Sum {
+		return Contribution{}, nil, fmt.Errorf("invalid contribution metric: %s: expected one of %s", metric, strings.Join(ContributionMetrics(), ", "))
+	}
+
+	var global Contribution
+	contribs := make([]Contribution, 0, len(metrics))
+	for id, r := range metrics {
+		c := Contribution{
+			Id:   id,
+			Base: mt.Value(r.Base),
+			Comp: mt.Value(r.Comp),
+		}
+		c.Delta = c.Comp - c.Base
+		global.Base += c.Base
+		global.Comp += c.Comp
+		contribs = append(contribs, c)
+	}
+	global.Delta = global.Comp - global.Base
+	if global.Delta != 0 {
+		global.Pct = 1
+		for i := range contribs {
+			contribs[i].Pct = contribs[i].Delta / global.Delta
+		}
+	}
+	sort.Slice(contribs, func(i, j int) bool {
+		if contribs[i].Pct != contribs[j].Pct {
+			return contribs[i].Pct > contribs[j].Pct
+		}
+		if contribs[i].Delta != contribs[j].Delta {
+			return contribs[i].Delta > contribs[j].Delta // global didn't change
+		}
+		return contribs[i].Id < contribs[j].Id
+	})
+	return global, contribs, nil
+}
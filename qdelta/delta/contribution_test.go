@@ -0,0 +1,82 @@
+package delta_test
+
+import (
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	gomysql "github.com/go-mysql/slowlog"
+	"github.com/go-test/deep"
+)
+
+func TestContributions(t *testing.T) {
+	metrics := map[string]delta.Result{
+		"X": {InBase: true, InComp: true, Base: delta.Metrics{QPS: 10, Load: 1}, Comp: delta.Metrics{QPS: 30, Load: 1}},
+		"Y": {InBase: true, Base: delta.Metrics{QPS: 10, Load: 2}}, // miss
+		"Z": {InComp: true, Comp: delta.Metrics{QPS: 15, Load: 1}}, // new
+		"W": {InBase: true, InComp: true, Base: delta.Metrics{QPS: 5}, Comp: delta.Metrics{QPS: 5}},
+	}
+
+	global, contribs, err := delta.Contributions(metrics, "qps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(global, delta.Contribution{Base: 25, Comp: 50, Delta: 25, Pct: 1}); diff != nil {
+		t.Error(diff)
+	}
+	expect := []delta.Contribution{
+		{Id: "X", Base: 10, Comp: 30, Delta: 20, Pct: 0.8},
+		{Id: "Z", Base: 0, Comp: 15, Delta: 15, Pct: 0.6},
+		{Id: "W", Base: 5, Comp: 5, Delta: 0, Pct: 0},
+		{Id: "Y", Base: 10, Comp: 0, Delta: -10, Pct: -0.4},
+	}
+	if diff := deep.Equal(contribs, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Load decreased by 1: Y decreased 2 (200%), Z offset half of it (-100%)
+	global, contribs, err = delta.Contributions(metrics, "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global.Delta != -1 {
+		t.Errorf("got global load delta %f, expected -1", global.Delta)
+	}
+	var sum float64
+	for _, c := range contribs {
+		sum += c.Pct
+	}
+	if contribs[0].Id != "Y" || contribs[0].Pct != 2 || sum != 1 {
+		t.Errorf("got first %s %f, sum %f, expected Y 2 (200%%), sum 1", contribs[0].Id, contribs[0].Pct, sum)
+	}
+
+	// Percentages and unknown metrics aren't sums
+	for _, metric := range []string{"count", "nope"} {
+		if _, _, err := delta.Contributions(metrics, metric); err == nil {
+			t.Errorf("no error for %s", metric)
+		}
+	}
+
+	// Registered Sum metrics can be broken down, too
+	err = delta.Register(delta.Metric{
+		Name:  "rows-examined-per-sec",
+		Class: func(class *gomysql.Class, t delta.Totals) float64 { return 0 },
+		Sum:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delta.Unregister("rows-examined-per-sec")
+	if diff := deep.Equal(delta.ContributionMetrics(), []string{"qps", "load", "rows-examined-per-sec"}); diff != nil {
+		t.Error(diff)
+	}
+	x := metrics["X"]
+	x.Comp.Custom = map[string]float64{"rows-examined-per-sec": 100}
+	metrics["X"] = x
+	global, _, err = delta.Contributions(metrics, "rows-examined-per-sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global.Delta != 100 {
+		t.Errorf("got global rows examined per sec delta %f, expected 100", global.Delta)
+	}
+}
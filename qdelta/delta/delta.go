@@ -2,19 +2,36 @@ package delta
 
 import (
 	"fmt"
-	"math"
-	"sort"
-	"strings"
 
 	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	gomysql "github.com/go-mysql/slowlog"
 )
 
 type Metrics struct {
-	Id          string
-	QPS         float64
-	Load        float64
-	CountPct    float64
-	ExecTimePct float64
+	Id           string
+	QPS          float64
+	Load         float64
+	CountPct     float64
+	ExecTimePct  float64
+	AvgTime      float64 // Query_time average (seconds)
+	P95Time      float64 // Query_time 95th percentile (seconds)
+	AvgTimeRel   float64 // deltas only: AvgTime change relative to base
+	P95TimeRel   float64 // deltas only: P95Time change relative to base
+	LockTime     float64 // Lock_time per query (seconds)
+	RowsExamined float64 // Rows_examined per query
+	RowsSent     float64 // Rows_sent per query
+
+	// Percona Server extended slow log (log_slow_verbosity), else zero
+	IOReadOps   float64 // InnoDB_IO_r_ops per query
+	RecLockWait float64 // InnoDB_rec_lock_wait per query (seconds)
+	QueueWait   float64 // InnoDB_queue_wait per query (seconds)
+	TmpTables   float64 // Tmp_tables per query
+	FullScanPct float64 // fraction of queries with Full_scan
+	FilesortPct float64 // fraction of queries with Filesort
+	BytesSent   float64 // Bytes_sent per query
+
+	// Registered metrics, keyed on name. See Register.
+	Custom map[string]float64 `json:",omitempty"`
 }
 
 type Result struct {
@@ -22,39 +39,28 @@ type Result struct {
 	InComp bool
 	Base   Metrics
 	Comp   Metrics
+
+	// Confidence of each metric delta: how confident the delta is real, not
+	// noise, from 0 (e.g. 3 vs. 5 queries) to 1 (e.g. 10k vs. 50k queries).
+	// It's 1 - p-value of a two-sided test that base and comp are the same.
+	Confidence Metrics
+
+	// BaseId is the ID of the base query if it changed to this query, e.g.
+	// a column was added. See MatchChanged.
+	BaseId string `json:",omitempty"`
 }
 
 func Merge(base, comp slowlog.Result) map[string]Result {
 	metrics := map[string]Result{}
 
-	gTotalTime := base.End.Sub(base.Begin).Seconds()
-	gTotalQueries := float64(base.Global.TotalQueries)
-	gTotalExecTime := base.Global.Metrics.TimeMetrics["Query_time"].Sum
-
-	for id, class := range base.Class {
-		d := Metrics{
-			QPS:         float64(class.TotalQueries) / gTotalTime,
-			Load:        class.Metrics.TimeMetrics["Query_time"].Sum / gTotalTime,
-			CountPct:    float64(class.TotalQueries) / gTotalQueries,
-			ExecTimePct: class.Metrics.TimeMetrics["Query_time"].Sum / gTotalExecTime,
-		}
+	for id, d := range classMetrics(base) {
 		metrics[id] = Result{
 			InBase: true,
 			Base:   d,
 		}
 	}
 
-	gTotalTime = comp.End.Sub(comp.Begin).Seconds()
-	gTotalQueries = float64(comp.Global.TotalQueries)
-	gTotalExecTime = comp.Global.Metrics.TimeMetrics["Query_time"].Sum
-
-	for id, class := range comp.Class {
-		d := Metrics{
-			QPS:         float64(class.TotalQueries) / gTotalTime,
-			Load:        class.Metrics.TimeMetrics["Query_time"].Sum / gTotalTime,
-			CountPct:    float64(class.TotalQueries) / gTotalQueries,
-			ExecTimePct: class.Metrics.TimeMetrics["Query_time"].Sum / gTotalExecTime,
-		}
+	for id, d := range classMetrics(comp) {
 		if r, ok := metrics[id]; !ok {
 			// new query
 			metrics[id] = Result{
@@ -69,10 +75,99 @@ func Merge(base, comp slowlog.Result) map[string]Result {
 		}
 	}
 
+	for id, r := range metrics {
+		r.Confidence = confidence(id, base, comp)
+		metrics[id] = r
+	}
+
 	return metrics
 }
 
+// classMetrics returns the metrics of each class in res, keyed on class ID.
+func classMetrics(res slowlog.Result) map[string]Metrics {
+	return classMetricsFor(res, res.End.Sub(res.Begin).Seconds())
+}
+
+// classMetricsFor returns the metrics of each class in res given its total
+// clock time in seconds.
+func classMetricsFor(res slowlog.Result, gTotalTime float64) map[string]Metrics {
+	metrics := map[string]Metrics{}
+	if len(res.Class) == 0 {
+		return metrics // no events, no global metrics
+	}
+
+	// QPS and load are real queries, so scale by the sampling rate. The
+	// rest are ratios or per query, which sampling doesn't change.
+	totals := Totals{
+		Seconds:  gTotalTime,
+		Queries:  float64(res.Global.TotalQueries),
+		ExecTime: queryTime(res.Global).Sum,
+		Rate:     res.Rate(),
+	}
+
+	for id, class := range res.Class {
+		t := totals
+		t.Rate = res.ClassRate(id) // outliers aren't sampled, see slowlog.Result
+		var m Metrics
+		for _, mt := range registry {
+			if mt.Class != nil {
+				mt.set(&m, mt.Class(class, t))
+			}
+		}
+		metrics[id] = m
+	}
+
+	return metrics
+}
+
+// queryTime returns the Query_time stats of the class, which are zero if it
+// doesn't have them, e.g. from a general log.
+func queryTime(class *gomysql.Class) *gomysql.TimeStats {
+	if s, ok := class.Metrics.TimeMetrics["Query_time"]; ok {
+		return s
+	}
+	return &gomysql.TimeStats{}
+}
+
+// perQueryTime returns the average of a time metric, or zero if the class
+// doesn't have it. Sum / Cnt is used because it's more precise than Avg.
+func perQueryTime(class *gomysql.Class, metric string) float64 {
+	s, ok := class.Metrics.TimeMetrics[metric]
+	if !ok || s.Cnt == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Cnt)
+}
+
+// perQueryNumber returns the average of a number metric, or zero if the class
+// doesn't have it. Sum / Cnt is used because Avg is an integer.
+func perQueryNumber(class *gomysql.Class, metric string) float64 {
+	s, ok := class.Metrics.NumberMetrics[metric]
+	if !ok || s.Cnt == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(s.Cnt)
+}
+
+// perQueryBool returns the fraction of queries for which a bool metric is
+// true, or zero if the class doesn't have it.
+func perQueryBool(class *gomysql.Class, metric string) float64 {
+	s, ok := class.Metrics.BoolMetrics[metric]
+	if !ok || class.TotalQueries == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(class.TotalQueries)
+}
+
+// OrderBy is every valid Delta orderBy: the name of every metric, built-in
+// and registered. See Register.
+var OrderBy []string
+
 func Delta(metrics map[string]Result, orderBy string) []Metrics {
+	mt, ok := Lookup(orderBy)
+	if !ok {
+		panic(fmt.Sprintf("invalid orderBy: %s", orderBy))
+	}
 	deltas := make([]Metrics, len(metrics))
 	i := 0
 	for id, r := range metrics {
@@ -81,28 +176,16 @@ func Delta(metrics map[string]Result, orderBy string) []Metrics {
 		deltas[i] = delta
 		i++
 	}
-	switch orderBy {
-	case "qps":
-		sort.Sort(byQPS(deltas))
-	case "load":
-		sort.Sort(byLoad(deltas))
-	case "count":
-		sort.Sort(byCountPct(deltas))
-	case "exectime":
-		sort.Sort(byExecTimePct(deltas))
-	default:
-		panic(fmt.Sprintf("invalid orderBy: %s", orderBy))
-	}
+	sortDeltas(deltas, mt)
 	return deltas
 }
 
 func metricsDelta(base, comp Metrics) Metrics {
-	return Metrics{
-		QPS:         diff(base.QPS, comp.QPS),
-		Load:        diff(base.Load, comp.Load),
-		CountPct:    diff(base.CountPct, comp.CountPct),
-		ExecTimePct: diff(base.ExecTimePct, comp.ExecTimePct),
+	var d Metrics
+	for _, mt := range registry {
+		mt.set(&d, mt.Delta(mt.Compared(base), mt.Compared(comp)))
 	}
+	return d
 }
 
 func diff(a, b float64) float64 {
@@ -115,56 +198,12 @@ func diff(a, b float64) float64 {
 	return (a - b) * -1.0
 }
 
-// //////////////////////////////////////////////////////////////////////////
-// Sort funcs
-// //////////////////////////////////////////////////////////////////////////
-
-// All sorts are descending to put the biggest absolute difference at top.
-
-type byQPS []Metrics
-
-func (a byQPS) Len() int      { return len(a) }
-func (a byQPS) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byQPS) Less(i, j int) bool {
-	if a[i].QPS == a[j].QPS {
-		// Sort by Id to make tests deterministic
-		return strings.Compare(a[i].Id, a[j].Id) < 0
-	}
-	return math.Abs(a[i].QPS) > math.Abs(a[j].QPS)
-}
-
-type byLoad []Metrics
-
-func (a byLoad) Len() int      { return len(a) }
-func (a byLoad) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byLoad) Less(i, j int) bool {
-	if a[i].Load == a[j].Load {
-		// Sort by Id to make tests deterministic
-		return strings.Compare(a[i].Id, a[j].Id) < 0
-	}
-	return math.Abs(a[i].Load) > math.Abs(a[j].Load)
-}
-
-type byCountPct []Metrics
-
-func (a byCountPct) Len() int      { return len(a) }
-func (a byCountPct) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byCountPct) Less(i, j int) bool {
-	if a[i].CountPct == a[j].CountPct {
-		// Sort by Id to make tests deterministic
-		return strings.Compare(a[i].Id, a[j].Id) < 0
-	}
-	return math.Abs(a[i].CountPct) > math.Abs(a[j].CountPct)
-}
-
-type byExecTimePct []Metrics
-
-func (a byExecTimePct) Len() int      { return len(a) }
-func (a byExecTimePct) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byExecTimePct) Less(i, j int) bool {
-	if a[i].ExecTimePct == a[j].ExecTimePct {
-		// Sort by Id to make tests deterministic
-		return strings.Compare(a[i].Id, a[j].Id) < 0
+func relDiff(a, b float64) float64 {
+	// 20 -> 40 ==  20 / 20 =  1.0 (100% increase)
+	// 40 -> 20 == -20 / 40 = -0.5 (50% decrease)
+	//  0 -> 40 == 0 (new query, no relative change)
+	if a == 0 {
+		return 0
 	}
-	return math.Abs(a[i].ExecTimePct) > math.Abs(a[j].ExecTimePct)
+	return diff(a, b) / a
 }
@@ -75,6 +75,8 @@ func Test001(t *testing.T) {
 			Load:        1.9444444444444444,
 			CountPct:    0.3333333333333333,
 			ExecTimePct: 0.24647887323943662,
+			AvgTime:     0.01,
+			P95Time:     0.05,
 		},
 		{
 			Id:          "E",
@@ -82,6 +84,8 @@ func Test001(t *testing.T) {
 			Load:        1.9444444444444444,
 			CountPct:    0.3333333333333333,
 			ExecTimePct: 0.24647887323943662,
+			AvgTime:     0.01,
+			P95Time:     0.05,
 		},
 		{
 			Id:          "A",
@@ -126,6 +130,8 @@ func Test001(t *testing.T) {
 			Load:        1.9444444444444444,
 			CountPct:    0.3333333333333333,
 			ExecTimePct: 0.24647887323943662,
+			AvgTime:     0.01,
+			P95Time:     0.05,
 		},
 		{
 			Id:          "E",
@@ -133,6 +139,8 @@ func Test001(t *testing.T) {
 			Load:        1.9444444444444444,
 			CountPct:    0.3333333333333333,
 			ExecTimePct: 0.24647887323943662,
+			AvgTime:     0.01,
+			P95Time:     0.05,
 		},
 		{
 			Id:          "B",
@@ -170,6 +178,8 @@ func Test001(t *testing.T) {
 			Load:        1.9444444444444444,
 			CountPct:    0.3333333333333333,
 			ExecTimePct: 0.24647887323943662,
+			AvgTime:     0.01,
+			P95Time:     0.05,
 		},
 		{
 			Id:          "E",
@@ -177,6 +187,8 @@ func Test001(t *testing.T) {
 			Load:        1.9444444444444444,
 			CountPct:    0.3333333333333333,
 			ExecTimePct: 0.24647887323943662,
+			AvgTime:     0.01,
+			P95Time:     0.05,
 		},
 		{
 			Id:          "A",
@@ -199,3 +211,195 @@ func Test001(t *testing.T) {
 		}
 	}
 }
+
+func TestLatency001(t *testing.T) {
+	base, err := loadSlowlogResults("001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("001-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Query A got 5x slower at the same QPS
+	comp.Class["A"].Metrics.TimeMetrics["Query_time"].Avg = 0.050
+	comp.Class["A"].Metrics.TimeMetrics["Query_time"].P95 = 0.250
+
+	metrics := delta.Merge(base, comp)
+	gotDeltas := delta.Delta(metrics, "avg-rel")
+	if gotDeltas[0].Id != "A" {
+		t.Fatalf("got %s first, expected A", gotDeltas[0].Id)
+	}
+	expect := []float64{0.04, 0.2, 4, 4} // avg, p95, avg rel, p95 rel
+	got := []float64{gotDeltas[0].AvgTime, gotDeltas[0].P95Time, gotDeltas[0].AvgTimeRel, gotDeltas[0].P95TimeRel}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+	if gotDeltas[0].QPS != 0 {
+		t.Errorf("got QPS delta %f, expected 0", gotDeltas[0].QPS)
+	}
+
+	// New queries D and E have no relative change, but their p95 delta is
+	// their whole p95, so they're after A and before B and C, which didn't change
+	gotDeltas = delta.Delta(metrics, "p95")
+	gotIds := []string{}
+	for _, d := range gotDeltas {
+		gotIds = append(gotIds, d.Id)
+	}
+	if diff := deep.Equal(gotIds, []string{"A", "D", "E", "B", "C"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func Test002(t *testing.T) {
+	// Query B has a plan regression: it examines 100x more rows at the
+	// same QPS, so it has more lock time and load, too
+	base, err := loadSlowlogResults("002-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("002-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := delta.Merge(base, comp)
+	gotDeltas := delta.Delta(metrics, "rows-examined")
+	expect := [][]float64{
+		// qps, lock time, rows examined, rows sent
+		{0, 0.009000000000000001, 990, 0}, // B
+		{0, 0, 0, 0},                      // A
+	}
+	for i, d := range gotDeltas {
+		got := []float64{d.QPS, d.LockTime, d.RowsExamined, d.RowsSent}
+		if diff := deep.Equal(got, expect[i]); diff != nil {
+			for _, d := range diff {
+				t.Errorf("%d: %s", i, d)
+			}
+		}
+	}
+	if gotDeltas[0].Id != "B" {
+		t.Errorf("got %s first, expected B", gotDeltas[0].Id)
+	}
+
+	// B rows examined is significant, unless the results are only sums
+	// (digests) because then the distribution is unknown
+	if c := metrics["B"].Confidence.RowsExamined; c < 0.99 {
+		t.Errorf("B rows examined confidence %f, expected > 0.99", c)
+	}
+	comp.SumsOnly = true
+	metrics = delta.Merge(base, comp)
+	if c := metrics["B"].Confidence.RowsExamined; c != 0 {
+		t.Errorf("B rows examined confidence %f, expected 0", c)
+	}
+	if c := metrics["B"].Confidence.QPS; c != 0 {
+		t.Errorf("B QPS confidence %f, expected 0", c)
+	}
+}
+
+func TestSignificance001(t *testing.T) {
+	base, err := loadSlowlogResults("001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("001-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Query C went from 3 to 5 executions: a big relative change that's
+	// probably noise
+	base.Class["C"].TotalQueries = 3
+	comp.Class["C"].TotalQueries = 5
+
+	metrics := delta.Merge(base, comp)
+	if c := metrics["C"].Confidence.QPS; c > 0.95 {
+		t.Errorf("C QPS confidence %f, expected < 0.95", c)
+	}
+	if c := metrics["D"].Confidence.QPS; c < 0.99 {
+		t.Errorf("D QPS confidence %f, expected > 0.99", c)
+	}
+	if c := metrics["A"].Confidence.QPS; c != 0 {
+		t.Errorf("A QPS confidence %f, expected 0", c)
+	}
+
+	// One execution of C took 10ms and one took 500ms: the difference is
+	// big, but it's unknown if it's real
+	for n, res := range []slowlog.Result{base, comp} {
+		qt := res.Class["C"].Metrics.TimeMetrics["Query_time"]
+		qt.Cnt = 1
+		qt.Sum = []float64{0.01, 0.5}[n]
+		qt.Avg, qt.Med, qt.P95 = qt.Sum, qt.Sum, qt.Sum
+	}
+	metrics = delta.Merge(base, comp)
+	if c := metrics["C"].Confidence.AvgTime; c != 0 {
+		t.Errorf("C avg time confidence %f, expected 0", c)
+	}
+}
+
+func Test003(t *testing.T) {
+	// Percona Server extended slow log: load increased because query A
+	// does full scans with more disk IO, and query B waits for row locks
+	base, err := loadSlowlogResults("003-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("003-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := delta.Merge(base, comp)
+	got := map[string][]float64{}
+	for _, d := range delta.Delta(metrics, "load") {
+		got[d.Id] = []float64{d.IOReadOps, d.RecLockWait, d.QueueWait, d.TmpTables, d.FullScanPct, d.FilesortPct, d.BytesSent}
+	}
+	expect := map[string][]float64{
+		// io r ops, rec lock wait, queue wait, tmp tables, full scan, filesort, bytes sent
+		"A": {19, 0, 0, 0, 0.5, 0, 0},
+		"B": {0, 0.02, 0, 0, 0, 0, 0},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+
+	// Half of A now does full scans vs. none before, so the delta is real
+	if c := metrics["A"].Confidence.FullScanPct; c < 0.99 {
+		t.Errorf("got full scan confidence %f, expected > 0.99", c)
+	}
+	if c := metrics["B"].Confidence.FilesortPct; c != 0 {
+		t.Errorf("got filesort confidence %f, expected 0", c)
+	}
+}
+
+func TestSampleRate001(t *testing.T) {
+	base, err := loadSlowlogResults("001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("001-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsampled := delta.Merge(base, comp)
+
+	// Comp logged 1 of every 2 queries, so it has twice the QPS and load,
+	// but the same count and exec time pct
+	comp.SampleRate = 2
+	sampled := delta.Merge(base, comp)
+	for id, r := range sampled {
+		u := unsampled[id].Comp
+		got := []float64{r.Comp.QPS, r.Comp.Load, r.Comp.CountPct, r.Comp.ExecTimePct}
+		expect := []float64{u.QPS * 2, u.Load * 2, u.CountPct, u.ExecTimePct}
+		if diff := deep.Equal(got, expect); diff != nil {
+			for _, d := range diff {
+				t.Errorf("%s: %s", id, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package delta
+
+// Unregister removes a metric registered by a test so other tests don't see it.
+var Unregister = unregister
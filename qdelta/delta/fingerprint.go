@@ -0,0 +1,205 @@
+package delta
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// DEFAULT_SIMILARITY is the default minimum similarity of a missing and new
+// query to be the same query changed.
+const DEFAULT_SIMILARITY = 0.8
+
+// Match is a missing query that changed to a new query.
+type Match struct {
+	BaseId     string  // missing query
+	CompId     string  // new query
+	Similarity float64 // see Similarity
+}
+
+// MatchChanged pairs missing and new queries that are probably the same query
+// changed, e.g. by a schema or ORM change: their fingerprints have the same
+// tables and at least minSimilarity (0-1). Each pair is merged into one
+// Result with base metrics from the missing query and comp metrics from the
+// new query, keyed on the new query ID with BaseId the missing query ID.
+// The most similar pairs are matched first, and each query is matched at
+// most once. The matches are returned in that order.
+func MatchChanged(metrics map[string]Result, base, comp slowlog.Result, minSimilarity float64) []Match {
+	type query struct {
+		id     string
+		tokens []string
+		tables string
+	}
+	parse := func(id, fingerprint string) query {
+		return query{id: id, tokens: tokens(fingerprint), tables: strings.Join(tables(fingerprint), ",")}
+	}
+	var missing, added []query
+	for id, r := range metrics {
+		switch {
+		case r.InBase && !r.InComp && base.Class[id] != nil:
+			missing = append(missing, parse(id, base.Class[id].Fingerprint))
+		case r.InComp && !r.InBase && comp.Class[id] != nil:
+			added = append(added, parse(id, comp.Class[id].Fingerprint))
+		}
+	}
+
+	candidates := []Match{}
+	for _, m := range missing {
+		for _, a := range added {
+			if m.tables != a.tables {
+				continue
+			}
+			if s := similarity(m.tokens, a.tokens); s >= minSimilarity {
+				candidates = append(candidates, Match{BaseId: m.id, CompId: a.id, Similarity: s})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Similarity != candidates[j].Similarity {
+			return candidates[i].Similarity > candidates[j].Similarity
+		}
+		if candidates[i].BaseId != candidates[j].BaseId {
+			return candidates[i].BaseId < candidates[j].BaseId
+		}
+		return candidates[i].CompId < candidates[j].CompId
+	})
+
+	matches := []Match{}
+	matched := map[string]bool{}
+	for _, c := range candidates {
+		if matched[c.BaseId] || matched[c.CompId] {
+			continue
+		}
+		matched[c.BaseId] = true
+		matched[c.CompId] = true
+		matches = append(matches, c)
+
+		r := Result{
+			InBase: true,
+			InComp: true,
+			Base:   metrics[c.BaseId].Base,
+			Comp:   metrics[c.CompId].Comp,
+			BaseId: c.BaseId,
+		}
+		r.Confidence = classConfidence(base.Class[c.BaseId], comp.Class[c.CompId], base, comp)
+		delete(metrics, c.BaseId)
+		metrics[c.CompId] = r
+	}
+	return matches
+}
+
+// Similarity returns how similar two fingerprints are, from 0 (nothing in
+// common) to 1 (same tokens): 1 - token edit distance / tokens in the longer
+// fingerprint.
+func Similarity(a, b string) float64 {
+	return similarity(tokens(a), tokens(b))
+}
+
+func similarity(a, b []string) float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(a, b))/float64(n)
+}
+
+var tokenRe = regexp.MustCompile("[a-z0-9_$@.]+|\\?|\\S")
+
+// tokens returns the fingerprint as lowercase words, placeholders, and
+// punctuation. Identifier quotes are removed so that a slow log fingerprint
+// (select c from t) and a digest (SELECT `c` FROM `t`) are the same.
+func tokens(fingerprint string) []string {
+	return tokenRe.FindAllString(strings.ToLower(strings.Replace(fingerprint, "`", "", -1)), -1)
+}
+
+// editDistance returns the Levenshtein distance between a and b in tokens:
+// the number of tokens inserted, deleted, or replaced to change a into b.
+func editDistance(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(vals ...int) int {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// tableKeywords are keywords after which a table name is expected.
+var tableKeywords = map[string]bool{
+	"from":   true,
+	"join":   true,
+	"into":   true,
+	"update": true,
+	"table":  true,
+}
+
+// notAlias are keywords that can follow a table name, so they're not its alias.
+var notAlias = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "right": true,
+	"outer": true, "cross": true, "natural": true, "straight_join": true,
+	"on": true, "using": true, "group": true, "order": true, "limit": true,
+	"having": true, "set": true, "values": true, "value": true, "select": true,
+	"union": true, "for": true, "lock": true, "force": true, "use": true,
+	"ignore": true, "partition": true, "window": true, "into": true, "(": true,
+	")": true, ";": true,
+}
+
+// tables returns the sorted, unique table names in the fingerprint: the
+// names after FROM (including comma-separated tables), JOIN, INTO, UPDATE,
+// and TABLE.
+func tables(fingerprint string) []string {
+	toks := tokens(fingerprint)
+	seen := map[string]bool{}
+	for i := 0; i < len(toks); i++ {
+		if !tableKeywords[toks[i]] {
+			continue
+		}
+		for i+1 < len(toks) && !notAlias[toks[i+1]] && toks[i+1] != "?" {
+			i++
+			seen[toks[i]] = true
+			// Skip alias: t AS a, t a
+			if i+1 < len(toks) && toks[i+1] == "as" {
+				i++
+			}
+			if i+1 < len(toks) && toks[i+1] != "," && !notAlias[toks[i+1]] {
+				i++
+			}
+			if i+1 < len(toks) && toks[i+1] == "," {
+				i++ // next table
+				continue
+			}
+			break
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
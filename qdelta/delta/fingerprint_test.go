@@ -0,0 +1,74 @@
+package delta_test
+
+import (
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/go-test/deep"
+)
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect float64
+	}{
+		{"select c from t where id=?", "select c from t where id=?", 1},
+		{"SELECT `c` FROM `t` WHERE `id` = ?", "select c from t where id=?", 1}, // digest vs. slow log
+		{"select a, b from t where id=?", "select a, b, c from t where id=?", 1 - 2.0/12},
+		{"select c from t", "delete from t", 1 - 2.0/4},
+		{"", "", 1},
+	}
+	for _, test := range tests {
+		if got := delta.Similarity(test.a, test.b); got != test.expect {
+			t.Errorf("Similarity(%q, %q) = %f, expected %f", test.a, test.b, got, test.expect)
+		}
+	}
+}
+
+func TestMatchChanged(t *testing.T) {
+	base, err := loadSlowlogResults("004-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("004-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := delta.Merge(base, comp)
+
+	// C changed to D (new column). B and E differ by one token, but they're
+	// different tables.
+	matches := delta.MatchChanged(metrics, base, comp, delta.DEFAULT_SIMILARITY)
+	expect := []delta.Match{
+		{BaseId: "C", CompId: "D", Similarity: 1 - 2.0/12},
+	}
+	if diff := deep.Equal(matches, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	if _, ok := metrics["C"]; ok {
+		t.Error("missing query C not removed")
+	}
+	d := metrics["D"]
+	if !d.InBase || !d.InComp || d.BaseId != "C" {
+		t.Errorf("got D InBase %t InComp %t BaseId '%s', expected true, true, C", d.InBase, d.InComp, d.BaseId)
+	}
+	if d.Base.QPS != 1 || d.Comp.QPS != 1 {
+		t.Errorf("got D QPS base %f comp %f, expected 1 and 1", d.Base.QPS, d.Comp.QPS)
+	}
+	if d.Base.AvgTime != 0.01 || d.Comp.AvgTime != 0.02 {
+		t.Errorf("got D avg time base %f comp %f, expected 0.01 and 0.02", d.Base.AvgTime, d.Comp.AvgTime)
+	}
+	if d.Confidence.AvgTime == 0 {
+		t.Error("D has no avg time confidence")
+	}
+	if !metrics["B"].InBase || metrics["B"].InComp || !metrics["E"].InComp || metrics["E"].InBase {
+		t.Error("B or E matched")
+	}
+
+	// Too dissimilar
+	metrics = delta.Merge(base, comp)
+	if matches := delta.MatchChanged(metrics, base, comp, 0.9); len(matches) != 0 {
+		t.Errorf("got %d matches at 0.9 similarity, expected 0", len(matches))
+	}
+}
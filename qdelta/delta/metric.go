@@ -0,0 +1,329 @@
+package delta
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	gomysql "github.com/go-mysql/slowlog"
+)
+
+// Unit is how the values of a metric are formatted and compared to -min-delta.
+type Unit int
+
+const (
+	NUMBER  Unit = iota // count or rate, e.g. QPS
+	PERCENT             // fraction 0-1, printed 0-100
+	SECONDS             // time, printed like 1.50s, 12.3ms, or 250us; -min-delta is ms
+)
+
+// Order is how Delta orders the deltas of a metric.
+type Order int
+
+const (
+	LARGEST  Order = iota // largest absolute delta first, increase or decrease
+	INCREASE              // largest increase first
+	DECREASE              // largest decrease first
+)
+
+// Totals are the global values of a result that a class metric can be
+// relative to.
+type Totals struct {
+	Seconds  float64 // clock time of the result
+	Queries  float64 // global query count
+	ExecTime float64 // global Query_time sum (seconds)
+	Rate     float64 // sampling rate of the class, see slowlog.Result.ClassRate
+}
+
+// Metric defines one metric of every query: how its value is calculated from
+// a class, how its delta is calculated and ordered, and how it's reported.
+// The built-in metrics are the Metrics fields. Other metrics are registered
+// with Register and their values are in Metrics.Custom.
+type Metric struct {
+	Name string // Delta orderBy and -metrics name, e.g. p95
+	Unit Unit
+
+	// Class returns the value of the class. It's required unless Of is set.
+	Class func(class *gomysql.Class, totals Totals) float64
+
+	// Of is the metric of which this metric is a different delta, like
+	// avg-rel of avg. Base and comp values are the Of metric's, so this
+	// metric only has a delta. Optional.
+	Of string
+
+	// Delta returns the delta from base to comp. Default: comp - base.
+	Delta func(base, comp float64) float64
+
+	// Confidence returns the confidence (0-1) that the delta of base (nil if
+	// new) vs. comp (nil if missing) is real. Optional: zero confidence if nil.
+	Confidence func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64
+
+	Order Order
+
+	// Sum is true if the global value is the sum of every query's, like QPS
+	// and load, so Contributions can break the global delta down by query.
+	// Percentages and Of metrics can't be summed.
+	Sum bool
+
+	field func(*Metrics) *float64 // built-in Metrics field, else Metrics.Custom
+}
+
+// Value returns the value of the metric in m.
+func (mt Metric) Value(m Metrics) float64 {
+	if mt.field != nil {
+		return *mt.field(&m)
+	}
+	return m.Custom[mt.Name]
+}
+
+func (mt Metric) set(m *Metrics, val float64) {
+	if mt.field != nil {
+		*mt.field(m) = val
+		return
+	}
+	if m.Custom == nil {
+		m.Custom = map[string]float64{}
+	}
+	m.Custom[mt.Name] = val
+}
+
+// Custom returns true if the metric was registered, i.e. it's not a Metrics field.
+func (mt Metric) Custom() bool {
+	return mt.field == nil
+}
+
+// registry is every metric by name.
+var registry = map[string]Metric{}
+
+func init() {
+	execTime := func(class *gomysql.Class) float64 { return queryTime(class).Sum }
+	builtin := []Metric{
+		{
+			Name: "qps", Unit: NUMBER, field: func(m *Metrics) *float64 { return &m.QPS },
+			Class: func(class *gomysql.Class, t Totals) float64 {
+				return float64(class.TotalQueries) * t.Rate / t.Seconds
+			},
+			Confidence: qpsConfidence,
+			Sum:        true,
+		},
+		{
+			Name: "load", Unit: NUMBER, field: func(m *Metrics) *float64 { return &m.Load },
+			Class: func(class *gomysql.Class, t Totals) float64 {
+				return execTime(class) * t.Rate / t.Seconds
+			},
+			// Load changes if either count or Query_time changes
+			Confidence: maxConfidence(qpsConfidence, TimeConfidence("Query_time")),
+			Sum:        true,
+		},
+		{
+			Name: "count", Unit: PERCENT, field: func(m *Metrics) *float64 { return &m.CountPct },
+			Class: func(class *gomysql.Class, t Totals) float64 {
+				return float64(class.TotalQueries) / t.Queries
+			},
+			Confidence: countConfidence,
+		},
+		{
+			Name: "exectime", Unit: PERCENT, field: func(m *Metrics) *float64 { return &m.ExecTimePct },
+			Class: func(class *gomysql.Class, t Totals) float64 {
+				if t.ExecTime <= 0 {
+					return 0
+				}
+				return execTime(class) / t.ExecTime
+			},
+			Confidence: maxConfidence(countConfidence, TimeConfidence("Query_time")),
+		},
+		{
+			Name: "avg", Unit: SECONDS, field: func(m *Metrics) *float64 { return &m.AvgTime },
+			Class: func(class *gomysql.Class, t Totals) float64 {
+				return queryTime(class).Avg
+			},
+			Confidence: TimeConfidence("Query_time"),
+		},
+		{
+			Name: "p95", Unit: SECONDS, field: func(m *Metrics) *float64 { return &m.P95Time },
+			Class: func(class *gomysql.Class, t Totals) float64 {
+				return queryTime(class).P95
+			},
+			Confidence: TimeConfidence("Query_time"),
+		},
+		{
+			Name: "avg-rel", Unit: PERCENT, field: func(m *Metrics) *float64 { return &m.AvgTimeRel },
+			Of: "avg", Delta: relDiff, Confidence: TimeConfidence("Query_time"),
+		},
+		{
+			Name: "p95-rel", Unit: PERCENT, field: func(m *Metrics) *float64 { return &m.P95TimeRel },
+			Of: "p95", Delta: relDiff, Confidence: TimeConfidence("Query_time"),
+		},
+		{
+			Name: "lock", Unit: SECONDS, field: func(m *Metrics) *float64 { return &m.LockTime },
+			Class: PerQueryTime("Lock_time"), Confidence: TimeConfidence("Lock_time"),
+		},
+		{
+			Name: "rows-examined", Unit: NUMBER, field: func(m *Metrics) *float64 { return &m.RowsExamined },
+			Class: PerQueryNumber("Rows_examined"), Confidence: NumberConfidence("Rows_examined"),
+		},
+		{
+			Name: "rows-sent", Unit: NUMBER, field: func(m *Metrics) *float64 { return &m.RowsSent },
+			Class: PerQueryNumber("Rows_sent"), Confidence: NumberConfidence("Rows_sent"),
+		},
+		{
+			Name: "io-r-ops", Unit: NUMBER, field: func(m *Metrics) *float64 { return &m.IOReadOps },
+			Class: PerQueryNumber("InnoDB_IO_r_ops"), Confidence: NumberConfidence("InnoDB_IO_r_ops"),
+		},
+		{
+			Name: "rec-lock-wait", Unit: SECONDS, field: func(m *Metrics) *float64 { return &m.RecLockWait },
+			Class: PerQueryTime("InnoDB_rec_lock_wait"), Confidence: TimeConfidence("InnoDB_rec_lock_wait"),
+		},
+		{
+			Name: "queue-wait", Unit: SECONDS, field: func(m *Metrics) *float64 { return &m.QueueWait },
+			Class: PerQueryTime("InnoDB_queue_wait"), Confidence: TimeConfidence("InnoDB_queue_wait"),
+		},
+		{
+			Name: "tmp-tables", Unit: NUMBER, field: func(m *Metrics) *float64 { return &m.TmpTables },
+			Class: PerQueryNumber("Tmp_tables"), Confidence: NumberConfidence("Tmp_tables"),
+		},
+		{
+			Name: "full-scan", Unit: PERCENT, field: func(m *Metrics) *float64 { return &m.FullScanPct },
+			Class: PerQueryBool("Full_scan"), Confidence: BoolConfidence("Full_scan"),
+		},
+		{
+			Name: "filesort", Unit: PERCENT, field: func(m *Metrics) *float64 { return &m.FilesortPct },
+			Class: PerQueryBool("Filesort"), Confidence: BoolConfidence("Filesort"),
+		},
+		{
+			Name: "bytes-sent", Unit: NUMBER, field: func(m *Metrics) *float64 { return &m.BytesSent },
+			Class: PerQueryNumber("Bytes_sent"), Confidence: NumberConfidence("Bytes_sent"),
+		},
+	}
+	for _, mt := range builtin {
+		if err := register(mt); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register adds a metric. It's reported like the built-in metrics and can
+// be a Delta orderBy. Register metrics before calling Merge, usually in an
+// init func.
+func Register(mt Metric) error {
+	return register(mt)
+}
+
+func register(mt Metric) error {
+	if mt.Name == "" || strings.ContainsAny(mt.Name, ", ") {
+		return fmt.Errorf("invalid metric name: '%s'", mt.Name)
+	}
+	if _, ok := registry[mt.Name]; ok {
+		return fmt.Errorf("metric %s already registered", mt.Name)
+	}
+	if mt.Of != "" {
+		if of, ok := registry[mt.Of]; !ok || of.Of != "" {
+			return fmt.Errorf("metric %s: invalid Of: %s: not a registered metric with a Class", mt.Name, mt.Of)
+		}
+	} else if mt.Class == nil {
+		return fmt.Errorf("metric %s: Class or Of is required", mt.Name)
+	}
+	if mt.Sum && (mt.Unit == PERCENT || mt.Of != "") {
+		return fmt.Errorf("metric %s: invalid Sum: percentages and Of metrics can't be summed", mt.Name)
+	}
+	if mt.Delta == nil {
+		mt.Delta = diff
+	}
+	registry[mt.Name] = mt
+	OrderBy = append(OrderBy, mt.Name)
+	return nil
+}
+
+func unregister(name string) {
+	delete(registry, name)
+	for i, n := range OrderBy {
+		if n == name {
+			OrderBy = append(OrderBy[:i:i], OrderBy[i+1:]...)
+			break
+		}
+	}
+}
+
+// Lookup returns the metric with the name, if registered.
+func Lookup(name string) (Metric, bool) {
+	mt, ok := registry[name]
+	return mt, ok
+}
+
+// Registered returns every metric in OrderBy order: the built-in metrics
+// first, then registered metrics in the order they were registered.
+func Registered() []Metric {
+	metrics := make([]Metric, len(OrderBy))
+	for i, name := range OrderBy {
+		metrics[i] = registry[name]
+	}
+	return metrics
+}
+
+// ParseMetrics returns the metrics in a comma-separated list of names like
+// "qps,load,p95", or an error if one isn't registered.
+func ParseMetrics(names string) ([]Metric, error) {
+	metrics := []Metric{}
+	for _, name := range strings.Split(names, ",") {
+		mt, ok := Lookup(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("invalid metric: %s: expected one of %s", name, strings.Join(OrderBy, ", "))
+		}
+		metrics = append(metrics, mt)
+	}
+	return metrics, nil
+}
+
+// Compared returns the value of the metric in base or comp Metrics: its Of
+// metric's value if set, else its own.
+func (mt Metric) Compared(m Metrics) float64 {
+	if mt.Of != "" {
+		return registry[mt.Of].Value(m)
+	}
+	return mt.Value(m)
+}
+
+// sortDeltas sorts deltas by the metric in its Order. Deltas with equal sort
+// keys are sorted by ID to make tests deterministic. For LARGEST, that
+// includes an increase and decrease of the same size, like +0.25 and -0.25,
+// which are otherwise neither less nor equal, so their order depends on map
+// order.
+func sortDeltas(deltas []Metrics, mt Metric) {
+	key := func(d Metrics) float64 {
+		v := mt.Value(d)
+		switch mt.Order {
+		case INCREASE:
+			return v
+		case DECREASE:
+			return -v
+		}
+		return math.Abs(v)
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		ki, kj := key(deltas[i]), key(deltas[j])
+		if ki == kj {
+			return strings.Compare(deltas[i].Id, deltas[j].Id) < 0
+		}
+		return ki > kj
+	})
+}
+
+// PerQueryTime returns a Class func for the average of a time metric, e.g.
+// Lock_time, or zero if the class doesn't have it.
+func PerQueryTime(metric string) func(*gomysql.Class, Totals) float64 {
+	return func(class *gomysql.Class, t Totals) float64 { return perQueryTime(class, metric) }
+}
+
+// PerQueryNumber returns a Class func for the average of a number metric,
+// e.g. Rows_sent, or zero if the class doesn't have it.
+func PerQueryNumber(metric string) func(*gomysql.Class, Totals) float64 {
+	return func(class *gomysql.Class, t Totals) float64 { return perQueryNumber(class, metric) }
+}
+
+// PerQueryBool returns a Class func for the fraction of queries for which a
+// bool metric is true, e.g. Full_scan, or zero if the class doesn't have it.
+func PerQueryBool(metric string) func(*gomysql.Class, Totals) float64 {
+	return func(class *gomysql.Class, t Totals) float64 { return perQueryBool(class, metric) }
+}
@@ -0,0 +1,104 @@
+package delta_test
+
+import (
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	gomysql "github.com/go-mysql/slowlog"
+	"github.com/go-test/deep"
+)
+
+func TestRegister(t *testing.T) {
+	base, err := loadSlowlogResults("002-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("002-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows examined per row sent: B went from 10 to 1000 (lost an index)
+	examined := delta.PerQueryNumber("Rows_examined")
+	sent := delta.PerQueryNumber("Rows_sent")
+	err = delta.Register(delta.Metric{
+		Name: "examined-per-sent",
+		Unit: delta.NUMBER,
+		Class: func(class *gomysql.Class, t delta.Totals) float64 {
+			return examined(class, t) / sent(class, t)
+		},
+		Confidence: delta.NumberConfidence("Rows_examined"),
+		Order:      delta.DECREASE,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delta.Unregister("examined-per-sent")
+
+	if o := delta.OrderBy[len(delta.OrderBy)-1]; o != "examined-per-sent" {
+		t.Errorf("got last orderBy %s, expected examined-per-sent", o)
+	}
+
+	metrics := delta.Merge(base, comp)
+	b := metrics["B"]
+	if b.Base.Custom["examined-per-sent"] != 10 || b.Comp.Custom["examined-per-sent"] != 1000 {
+		t.Errorf("got B base %v comp %v, expected 10 and 1000", b.Base.Custom, b.Comp.Custom)
+	}
+	if b.Confidence.Custom["examined-per-sent"] == 0 {
+		t.Error("B has no confidence")
+	}
+
+	mt, ok := delta.Lookup("examined-per-sent")
+	if !ok {
+		t.Fatal("metric not registered")
+	}
+	deltas := delta.Delta(metrics, "examined-per-sent")
+	got := map[string]float64{}
+	ids := []string{}
+	for _, d := range deltas {
+		got[d.Id] = mt.Value(d)
+		ids = append(ids, d.Id)
+	}
+	if diff := deep.Equal(got, map[string]float64{"A": 0, "B": 990}); diff != nil {
+		t.Error(diff)
+	}
+	// Largest decrease first, so the increase is last
+	if diff := deep.Equal(ids, []string{"A", "B"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Built-in metrics are the same
+	if d := deltas[1]; d.RowsExamined != 990 {
+		t.Errorf("got B rows examined delta %f, expected 990", d.RowsExamined)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	class := delta.PerQueryTime("Query_time")
+	invalid := []delta.Metric{
+		{Name: "qps", Class: class},                                     // duplicate
+		{Name: "a,b", Class: class},                                     // name
+		{Name: "no-class"},                                              // Class or Of
+		{Name: "bad-of", Of: "nope"},                                    // Of not registered
+		{Name: "rel-of-rel", Of: "avg-rel", Class: class},               // Of is Of
+		{Name: "sum-pct", Unit: delta.PERCENT, Class: class, Sum: true}, // Sum percentage
+		{Name: "sum-of", Of: "avg", Sum: true},                          // Sum Of
+	}
+	n := len(delta.OrderBy)
+	for _, mt := range invalid {
+		if err := delta.Register(mt); err == nil {
+			t.Errorf("no error registering %s", mt.Name)
+			delta.Unregister(mt.Name)
+		}
+	}
+	if len(delta.OrderBy) != n {
+		t.Errorf("got %d metrics, expected %d", len(delta.OrderBy), n)
+	}
+
+	if _, err := delta.ParseMetrics("qps,p95"); err != nil {
+		t.Error(err)
+	}
+	if _, err := delta.ParseMetrics("qps,nope"); err == nil {
+		t.Error("no error parsing invalid metric")
+	}
+}
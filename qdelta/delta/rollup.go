@@ -0,0 +1,95 @@
+package delta
+
+import (
+	"fmt"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	gomysql "github.com/go-mysql/slowlog"
+)
+
+// ROLLUPS are the levels above queries that results can be rolled up to:
+// every query is summed into its tables, statement type, or database.
+var ROLLUPS = []string{"table", "type", "db"}
+
+// ROLLUP_ORDER_BY are the deltas reported for a rollup level. Per-query
+// metrics like avg don't mean much for a table or database.
+var ROLLUP_ORDER_BY = []string{"qps", "load", "count", "exectime"}
+
+// NONE is the rollup ID of queries without a table (SELECT NOW()) or db.
+const NONE = "(none)"
+
+// statementTypes maps the first word of a fingerprint to its statement type.
+// Other statements (SET, SHOW, CALL, etc.) are OTHER.
+var statementTypes = map[string]string{
+	"select":   "SELECT",
+	"with":     "SELECT",
+	"(":        "SELECT", // (SELECT ...) UNION (SELECT ...)
+	"insert":   "INSERT",
+	"replace":  "INSERT",
+	"update":   "UPDATE",
+	"delete":   "DELETE",
+	"create":   "DDL",
+	"alter":    "DDL",
+	"drop":     "DDL",
+	"truncate": "DDL",
+	"rename":   "DDL",
+}
+
+// Rollup returns the result rolled up to the level: one class for each table
+// (ID is the table name), statement type (SELECT, INSERT, UPDATE, DELETE,
+// DDL, or OTHER), or database, and the fingerprint is the level, ID, and
+// number of unique queries. A query that accesses several tables is added
+// to each of them, so the table level can sum to more than all queries. The
+// result works like a query result with Merge, Delta, and report.
+func Rollup(res slowlog.Result, level string) (slowlog.Result, error) {
+	var keys func(*gomysql.Class) []string
+	switch level {
+	case "table":
+		keys = func(c *gomysql.Class) []string {
+			t := tables(c.Fingerprint)
+			if len(t) == 0 {
+				return []string{NONE}
+			}
+			return t
+		}
+	case "type":
+		keys = func(c *gomysql.Class) []string {
+			return []string{StatementType(c.Fingerprint)}
+		}
+	case "db":
+		keys = func(c *gomysql.Class) []string {
+			db := c.Db
+			if db == "" && c.Example != nil {
+				db = c.Example.Db
+			}
+			if db == "" {
+				db = NONE
+			}
+			return []string{db}
+		}
+	default:
+		return slowlog.Result{}, fmt.Errorf("invalid rollup: %s: expected table, type, or db", level)
+	}
+	rolled := slowlog.Regroup(res, keys)
+	for key, c := range rolled.Class {
+		queries := "queries"
+		if c.UniqueQueries == 1 {
+			queries = "query"
+		}
+		c.Fingerprint = fmt.Sprintf("%s %s (%d %s)", level, key, c.UniqueQueries, queries)
+	}
+	return rolled, nil
+}
+
+// StatementType returns the statement type of the fingerprint: SELECT,
+// INSERT (including REPLACE), UPDATE, DELETE, DDL, or OTHER.
+func StatementType(fingerprint string) string {
+	toks := tokens(fingerprint)
+	if len(toks) == 0 {
+		return "OTHER"
+	}
+	if t, ok := statementTypes[toks[0]]; ok {
+		return t
+	}
+	return "OTHER"
+}
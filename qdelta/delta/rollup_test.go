@@ -0,0 +1,96 @@
+package delta_test
+
+import (
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/go-test/deep"
+)
+
+func TestRollup(t *testing.T) {
+	base, err := loadSlowlogResults("005-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("005-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Base QPS and comp QPS of each table, type, and db. Every query is 1 QPS.
+	expect := map[string]map[string][2]float64{
+		"table": {
+			"t":  {1, 1}, // A joins t and t5
+			"t5": {1, 1},
+			"t2": {1, 0},
+			"t3": {1, 1}, // C changed to D
+			"t4": {0, 1},
+		},
+		"type": {
+			"SELECT": {3, 3},
+		},
+		"db": {
+			"app":  {2, 2},
+			"app2": {1, 1},
+		},
+	}
+	for _, level := range delta.ROLLUPS {
+		rolledBase, err := delta.Rollup(base, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rolledComp, err := delta.Rollup(comp, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string][2]float64{}
+		for id, r := range delta.Merge(rolledBase, rolledComp) {
+			got[id] = [2]float64{r.Base.QPS, r.Comp.QPS}
+		}
+		if diff := deep.Equal(got, expect[level]); diff != nil {
+			t.Errorf("%s: %v", level, diff)
+		}
+		if rolledBase.Global.TotalQueries != base.Global.TotalQueries {
+			t.Errorf("%s: got global %d queries, expected %d", level, rolledBase.Global.TotalQueries, base.Global.TotalQueries)
+		}
+	}
+
+	// Sums are exact, so per-query metrics of a rollup are too
+	rolled, _ := delta.Rollup(comp, "table")
+	if s := rolled.Class["t3"].Metrics.TimeMetrics["Query_time"].Sum; s != 72 {
+		t.Errorf("got t3 Query_time sum %f, expected 72", s)
+	}
+	if fp := rolled.Class["t3"].Fingerprint; fp != "table t3 (1 query)" {
+		t.Errorf("got t3 fingerprint '%s', expected 'table t3 (1 query)'", fp)
+	}
+	rolled, _ = delta.Rollup(comp, "db")
+	if fp := rolled.Class["app"].Fingerprint; fp != "db app (2 queries)" {
+		t.Errorf("got app fingerprint '%s', expected 'db app (2 queries)'", fp)
+	}
+	if len(comp.Class) != 3 {
+		t.Errorf("comp modified: got %d classes, expected 3", len(comp.Class))
+	}
+
+	if _, err := delta.Rollup(base, "user"); err == nil {
+		t.Error("no error for invalid rollup")
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	tests := map[string]string{
+		"select c from t where id=?":                "SELECT",
+		"(select c from t) union (select c from u)": "SELECT",
+		"insert into t(a) values(?+)":               "INSERT",
+		"replace into t(a) values(?+)":              "INSERT",
+		"UPDATE `t` SET `c` = ? WHERE `id` = ?":     "UPDATE",
+		"delete from t where id=?":                  "DELETE",
+		"alter table t add column c int":            "DDL",
+		"set autocommit=?":                          "OTHER",
+		"":                                          "OTHER",
+	}
+	for fingerprint, expect := range tests {
+		if got := delta.StatementType(fingerprint); got != expect {
+			t.Errorf("StatementType(%q) = %s, expected %s", fingerprint, got, expect)
+		}
+	}
+}
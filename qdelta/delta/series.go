@@ -0,0 +1,131 @@
+package delta
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// Series is one query's metrics in each bucket of a time series. A bucket's
+// Metrics are zero if the query was not seen in the bucket.
+type Series struct {
+	Buckets []Metrics
+	Seen    []bool
+}
+
+// Change is how much one metric of a Series changed across its buckets.
+type Change struct {
+	Id    string
+	Jump  float64 // largest bucket-to-bucket change, increase > 0
+	At    int     // bucket index where Jump ends, i.e. Jump is from At-1 to At
+	Slope float64 // least squares slope, change per bucket
+	Min   float64
+	Max   float64
+}
+
+// MergeSeries returns the Series of every query in the buckets, keyed on
+// class ID. Every bucket is the same duration, which is used instead of each
+// result's actual begin and end times to calculate QPS and load, so a bucket
+// with only a few events isn't inflated. Consequently, the first and last
+// buckets can be low if the slow log doesn't cover them fully.
+func MergeSeries(buckets []slowlog.Result, bucket time.Duration) map[string]Series {
+	series := map[string]Series{}
+	for n, res := range buckets {
+		for id, m := range classMetricsFor(res, bucket.Seconds()) {
+			s, ok := series[id]
+			if !ok {
+				s = Series{
+					Buckets: make([]Metrics, len(buckets)),
+					Seen:    make([]bool, len(buckets)),
+				}
+				series[id] = s
+			}
+			s.Buckets[n] = m
+			s.Seen[n] = true
+		}
+	}
+	return series
+}
+
+// SeriesDelta returns how much the metric (any metric without Of, i.e. not
+// avg-rel or p95-rel) of each query changed, ordered by orderBy: jump or
+// slope. Like Delta, the biggest absolute change is first.
+func SeriesDelta(series map[string]Series, metric, orderBy string) []Change {
+	mt, ok := Lookup(metric)
+	if !ok || mt.Of != "" {
+		panic(fmt.Sprintf("invalid metric: %s", metric))
+	}
+	changes := make([]Change, 0, len(series))
+	for id, s := range series {
+		vals := make([]float64, len(s.Buckets))
+		for n, m := range s.Buckets {
+			vals[n] = mt.Value(m)
+		}
+		c := seriesChange(vals)
+		c.Id = id
+		changes = append(changes, c)
+	}
+	switch orderBy {
+	case "jump":
+		sortChanges(changes, func(c Change) float64 { return c.Jump })
+	case "slope":
+		sortChanges(changes, func(c Change) float64 { return c.Slope })
+	default:
+		panic(fmt.Sprintf("invalid orderBy: %s", orderBy))
+	}
+	return changes
+}
+
+func seriesChange(vals []float64) Change {
+	c := Change{}
+	if len(vals) == 0 {
+		return c
+	}
+
+	c.Min, c.Max = vals[0], vals[0]
+	for n := 1; n < len(vals); n++ {
+		if d := diff(vals[n-1], vals[n]); math.Abs(d) > math.Abs(c.Jump) {
+			c.Jump = d
+			c.At = n
+		}
+		c.Min = math.Min(c.Min, vals[n])
+		c.Max = math.Max(c.Max, vals[n])
+	}
+
+	// Least squares slope where x is bucket index: cov(x, y) / var(x)
+	n := float64(len(vals))
+	meanX := (n - 1) / 2
+	meanY := 0.0
+	for _, y := range vals {
+		meanY += y
+	}
+	meanY /= n
+	var cov, varX float64
+	for x, y := range vals {
+		dx := float64(x) - meanX
+		cov += dx * (y - meanY)
+		varX += dx * dx
+	}
+	if varX > 0 {
+		c.Slope = cov / varX
+	}
+
+	return c
+}
+
+// sortChanges sorts changes by the absolute value of a field, largest first,
+// like sortDeltas.
+func sortChanges(changes []Change, field func(Change) float64) {
+	sort.Slice(changes, func(i, j int) bool {
+		fi, fj := field(changes[i]), field(changes[j])
+		if math.Abs(fi) == math.Abs(fj) {
+			// Sort by Id to make tests deterministic
+			return strings.Compare(changes[i].Id, changes[j].Id) < 0
+		}
+		return math.Abs(fi) > math.Abs(fj)
+	})
+}
@@ -0,0 +1,44 @@
+package delta_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	"github.com/go-test/deep"
+)
+
+func TestSeries001(t *testing.T) {
+	base, err := loadSlowlogResults("001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("001-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both results are 1h, so 1h buckets have the same QPS as Merge
+	series := delta.MergeSeries([]slowlog.Result{base, comp, comp}, time.Hour)
+	if len(series) != 5 {
+		t.Fatalf("got %d series, expected 5", len(series))
+	}
+	if diff := deep.Equal(series["D"].Seen, []bool{false, true, true}); diff != nil {
+		t.Error(diff)
+	}
+
+	gotChanges := delta.SeriesDelta(series, "qps", "jump")
+	expectChanges := []delta.Change{
+		{Id: "D", Jump: 100, At: 1, Slope: 50, Min: 0, Max: 100},
+		{Id: "E", Jump: 100, At: 1, Slope: 50, Min: 0, Max: 100},
+		{Id: "A", Jump: 0, At: 0, Slope: 0, Min: 55.55555555555556, Max: 55.55555555555556},
+		{Id: "B", Jump: 0, At: 0, Slope: 0, Min: 38.888888888888886, Max: 38.888888888888886},
+		{Id: "C", Jump: 0, At: 0, Slope: 0, Min: 5.555555555555555, Max: 5.555555555555555},
+	}
+	if diff := deep.Equal(gotChanges, expectChanges); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
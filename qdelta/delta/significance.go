@@ -0,0 +1,224 @@
+package delta
+
+import (
+	"math"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	gomysql "github.com/go-mysql/slowlog"
+)
+
+// confidence returns the confidence of every metric of the class.
+func confidence(id string, baseRes, compRes slowlog.Result) Metrics {
+	return classConfidence(baseRes.Class[id], compRes.Class[id], baseRes, compRes)
+}
+
+// classConfidence returns the confidence of every metric of the base class
+// (nil if new) vs. the comp class (nil if missing), which are usually the
+// same query.
+func classConfidence(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) Metrics {
+	var c Metrics
+	for _, mt := range registry {
+		if mt.Confidence != nil {
+			mt.set(&c, mt.Confidence(base, comp, baseRes, compRes))
+		}
+	}
+	return c
+}
+
+// qpsConfidence is the confidence that the rate of queries changed.
+func qpsConfidence(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+	n1, n2 := totalQueries(base), totalQueries(comp)
+	// Events are the samples, so a sampled result is like n events in
+	// less time, not more events
+	return rateConfidence(
+		n1, baseRes.End.Sub(baseRes.Begin).Seconds()/classRate(baseRes, base),
+		n2, compRes.End.Sub(compRes.Begin).Seconds()/classRate(compRes, comp),
+	)
+}
+
+// classRate returns the sampling rate of the class, or of res if nil.
+func classRate(res slowlog.Result, class *gomysql.Class) float64 {
+	if class == nil {
+		return res.Rate()
+	}
+	return res.ClassRate(class.Id)
+}
+
+// countConfidence is the confidence that the fraction of all queries changed.
+func countConfidence(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+	if baseRes.Global == nil || compRes.Global == nil {
+		return 0
+	}
+	return proportionConfidence(totalQueries(base), baseRes.Global.TotalQueries, totalQueries(comp), compRes.Global.TotalQueries)
+}
+
+// maxConfidence returns a Confidence func that is the max of a and b, for a
+// metric that changes if either one changes.
+func maxConfidence(a, b func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64) func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+	return func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+		return math.Max(a(base, comp, baseRes, compRes), b(base, comp, baseRes, compRes))
+	}
+}
+
+// TimeConfidence returns a Confidence func for the mean of a time metric,
+// e.g. Lock_time. See meanConfidence.
+func TimeConfidence(metric string) func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+	return func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+		if baseRes.SumsOnly || compRes.SumsOnly {
+			return 0 // no distribution to estimate the standard deviation
+		}
+		return timeConfidence(base, comp, metric)
+	}
+}
+
+// NumberConfidence returns a Confidence func for the mean of a number
+// metric, e.g. Rows_sent. See meanConfidence.
+func NumberConfidence(metric string) func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+	return func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+		if baseRes.SumsOnly || compRes.SumsOnly {
+			return 0 // no distribution to estimate the standard deviation
+		}
+		return numberConfidence(base, comp, metric)
+	}
+}
+
+// BoolConfidence returns a Confidence func for the fraction of queries for
+// which a bool metric is true, e.g. Full_scan. See proportionConfidence.
+func BoolConfidence(metric string) func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+	return func(base, comp *gomysql.Class, baseRes, compRes slowlog.Result) float64 {
+		return boolConfidence(base, comp, metric)
+	}
+}
+
+func totalQueries(class *gomysql.Class) uint {
+	if class == nil {
+		return 0
+	}
+	return class.TotalQueries
+}
+
+// rateConfidence tests if two Poisson rates are the same: n1 events in t1
+// seconds vs. n2 events in t2 seconds. Given n = n1 + n2, n2 is binomial
+// with p = t2 / (t1 + t2) if the rates are the same, which is approximated
+// by a normal distribution.
+func rateConfidence(n1 uint, t1 float64, n2 uint, t2 float64) float64 {
+	n := float64(n1 + n2)
+	if n == 0 || t1 <= 0 || t2 <= 0 {
+		return 0
+	}
+	p := t2 / (t1 + t2)
+	z := (float64(n2) - n*p) / math.Sqrt(n*p*(1-p))
+	return zConfidence(z)
+}
+
+// proportionConfidence tests if two proportions are the same: n1 of N1
+// queries vs. n2 of N2 queries.
+func proportionConfidence(n1, N1, n2, N2 uint) float64 {
+	if N1 == 0 || N2 == 0 {
+		return 0
+	}
+	p1 := float64(n1) / float64(N1)
+	p2 := float64(n2) / float64(N2)
+	p := float64(n1+n2) / float64(N1+N2)
+	se := math.Sqrt(p * (1 - p) * (1/float64(N1) + 1/float64(N2)))
+	if se == 0 {
+		return 0
+	}
+	return zConfidence((p2 - p1) / se)
+}
+
+// timeConfidence tests if the mean of a time metric is the same in base and
+// comp. See meanConfidence.
+func timeConfidence(base, comp *gomysql.Class, metric string) float64 {
+	if base == nil || comp == nil {
+		return 0 // per-query metrics can only be compared if the query is in both
+	}
+	s1, ok1 := base.Metrics.TimeMetrics[metric]
+	s2, ok2 := comp.Metrics.TimeMetrics[metric]
+	if !ok1 || !ok2 || s1.Cnt == 0 || s2.Cnt == 0 {
+		return 0
+	}
+	return meanConfidence(
+		float64(s1.Cnt), s1.Sum/float64(s1.Cnt), stddev(s1.Med, s1.P95),
+		float64(s2.Cnt), s2.Sum/float64(s2.Cnt), stddev(s2.Med, s2.P95),
+	)
+}
+
+// numberConfidence tests if the mean of a number metric is the same in base
+// and comp. See meanConfidence.
+func numberConfidence(base, comp *gomysql.Class, metric string) float64 {
+	if base == nil || comp == nil {
+		return 0 // per-query metrics can only be compared if the query is in both
+	}
+	s1, ok1 := base.Metrics.NumberMetrics[metric]
+	s2, ok2 := comp.Metrics.NumberMetrics[metric]
+	if !ok1 || !ok2 || s1.Cnt == 0 || s2.Cnt == 0 {
+		return 0
+	}
+	return meanConfidence(
+		float64(s1.Cnt), float64(s1.Sum)/float64(s1.Cnt), stddev(float64(s1.Med), float64(s1.P95)),
+		float64(s2.Cnt), float64(s2.Sum)/float64(s2.Cnt), stddev(float64(s2.Med), float64(s2.P95)),
+	)
+}
+
+// boolConfidence tests if the fraction of queries for which a bool metric is
+// true is the same in base and comp. See proportionConfidence.
+func boolConfidence(base, comp *gomysql.Class, metric string) float64 {
+	if base == nil || comp == nil {
+		return 0 // per-query metrics can only be compared if the query is in both
+	}
+	s1, ok1 := base.Metrics.BoolMetrics[metric]
+	s2, ok2 := comp.Metrics.BoolMetrics[metric]
+	if !ok1 && !ok2 {
+		return 0
+	}
+	var n1, n2 uint
+	if ok1 {
+		n1 = uint(s1.Sum)
+	}
+	if ok2 {
+		n2 = uint(s2.Sum)
+	}
+	return proportionConfidence(n1, base.TotalQueries, n2, comp.TotalQueries)
+}
+
+// MIN_MEAN_SAMPLES is the fewest values in base and comp for which
+// meanConfidence is known. With fewer, the normal approximation and the
+// estimated standard deviation are meaningless.
+const MIN_MEAN_SAMPLES = 10
+
+// meanConfidence is a Welch z-test of two means. The aggregated results don't
+// have samples or variance, only percentiles, so the standard deviations are
+// estimated by stddev. It's not a rank-sum or bootstrap test, which need the
+// values. The confidence is zero (unknown) if either side has fewer than
+// MIN_MEAN_SAMPLES values or no estimated standard deviation, e.g. one
+// execution, p95 equal to median, or a slowlog.Result.SumsOnly digest.
+// Latency is skewed, so the tail beyond p95 makes the real standard
+// deviation larger than the estimate, and the confidence is too high. The
+// README documents this for -significance.
+func meanConfidence(n1, mean1, sd1, n2, mean2, sd2 float64) float64 {
+	if mean1 == mean2 {
+		return 0
+	}
+	if n1 < MIN_MEAN_SAMPLES || n2 < MIN_MEAN_SAMPLES || sd1 == 0 || sd2 == 0 {
+		return 0
+	}
+	se := math.Sqrt(sd1*sd1/n1 + sd2*sd2/n2)
+	return zConfidence((mean2 - mean1) / se)
+}
+
+// stddev estimates standard deviation from the median and 95th percentile
+// as if the values are normally distributed: p95 = med + 1.645 sd. Query
+// times are usually skewed, so this is only a rough estimate. It's zero
+// (unknown) if p95 <= med.
+func stddev(med, p95 float64) float64 {
+	if p95 <= med {
+		return 0
+	}
+	return (p95 - med) / 1.645
+}
+
+// zConfidence returns 1 - two-sided p-value of a standard normal z score.
+func zConfidence(z float64) float64 {
+	return 1 - math.Erfc(math.Abs(z)/math.Sqrt2)
+}
@@ -0,0 +1,447 @@
+// Package digest reads snapshots of performance_schema.events_statements_summary_by_digest.
+// The table is cumulative, so the difference between two snapshots is the
+// workload between them, which Diff returns as a slowlog.Result, like
+// processing a slow log with long_query_time=0 for the same period.
+package digest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	gomysql "github.com/go-mysql/slowlog"
+)
+
+const (
+	// TIMER_PER_SECOND converts performance_schema timers (picoseconds) to
+	// seconds.
+	TIMER_PER_SECOND = 1e12
+
+	// ID_LEN is the length of class IDs, a prefix of DIGEST, which is 32 or
+	// 64 hex characters.
+	ID_LEN = 16
+
+	// SNAPSHOT_TIME is the optional column of when the snapshot was taken,
+	// e.g. SELECT NOW(6) AS SNAPSHOT_TIME, d.* FROM ... d.
+	SNAPSHOT_TIME = "SNAPSHOT_TIME"
+)
+
+// COLUMNS are the columns of a snapshot without a header, like SELECT * INTO
+// OUTFILE. Columns after SUM_NO_GOOD_INDEX_USED differ by MySQL version, so
+// they're ignored.
+var COLUMNS = []string{
+	"SCHEMA_NAME",
+	"DIGEST",
+	"DIGEST_TEXT",
+	"COUNT_STAR",
+	"SUM_TIMER_WAIT",
+	"MIN_TIMER_WAIT",
+	"AVG_TIMER_WAIT",
+	"MAX_TIMER_WAIT",
+	"SUM_LOCK_TIME",
+	"SUM_ERRORS",
+	"SUM_WARNINGS",
+	"SUM_ROWS_AFFECTED",
+	"SUM_ROWS_SENT",
+	"SUM_ROWS_EXAMINED",
+	"SUM_CREATED_TMP_DISK_TABLES",
+	"SUM_CREATED_TMP_TABLES",
+	"SUM_SELECT_FULL_JOIN",
+	"SUM_SELECT_FULL_RANGE_JOIN",
+	"SUM_SELECT_RANGE",
+	"SUM_SELECT_RANGE_CHECK",
+	"SUM_SELECT_SCAN",
+	"SUM_SORT_MERGE_PASSES",
+	"SUM_SORT_RANGE",
+	"SUM_SORT_ROWS",
+	"SUM_SORT_SCAN",
+	"SUM_NO_INDEX_USED",
+	"SUM_NO_GOOD_INDEX_USED",
+}
+
+// Snapshot is the table at one point in time.
+type Snapshot struct {
+	Time time.Time
+	Rows map[string]Row // DIGEST => row
+}
+
+// Row is one digest. Rows of the same digest in different schemas are summed,
+// in which case Schema is empty. Timers are picoseconds.
+type Row struct {
+	Digest        string
+	Schema        string
+	DigestText    string
+	Count         uint64 // COUNT_STAR
+	TimerWait     uint64 // SUM_TIMER_WAIT
+	LockTime      uint64 // SUM_LOCK_TIME
+	RowsSent      uint64
+	RowsExamined  uint64
+	TmpTables     uint64 // SUM_CREATED_TMP_TABLES
+	TmpDiskTables uint64 // SUM_CREATED_TMP_DISK_TABLES
+	SelectScan    uint64 // full table scans
+
+	// Since the table was truncated, not summed or diffed
+	MinTimerWait    uint64
+	MaxTimerWait    uint64
+	Quantile95      uint64 // MySQL 8.0
+	SampleText      string // QUERY_SAMPLE_TEXT, MySQL 8.0
+	SampleTimerWait uint64 // QUERY_SAMPLE_TIMER_WAIT, MySQL 8.0
+}
+
+// Read reads a snapshot exported as TSV (mysql -B, or SELECT INTO OUTFILE
+// with the table columns in order) or JSON (an array or stream of objects,
+// e.g. mysqlsh --result-format=json/array). Column names are the table
+// column names. The snapshot time is the SNAPSHOT_TIME column in loc (nil
+// means UTC), else the file modification time.
+func Read(file string, loc *time.Location) (Snapshot, error) {
+	snap := Snapshot{Rows: map[string]Row{}}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return snap, err
+	}
+	var rows []map[string]string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		rows, err = readJSON(data)
+	} else {
+		rows, err = readTSV(data)
+	}
+	if err != nil {
+		return snap, fmt.Errorf("cannot read %s: %s", file, err)
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+	for n, cols := range rows {
+		if ts := cols[SNAPSHOT_TIME]; ts != "" && snap.Time.IsZero() {
+			if snap.Time, err = time.ParseInLocation("2006-01-02 15:04:05.999999", ts, loc); err != nil {
+				return snap, fmt.Errorf("%s: invalid %s: %s", file, SNAPSHOT_TIME, err)
+			}
+		}
+		r, err := row(cols)
+		if err != nil {
+			return snap, fmt.Errorf("%s: row %d: %s", file, n+1, err)
+		}
+		if r.Digest == "" {
+			continue // NULL digest: statements not counted because the table was full
+		}
+		if prev, ok := snap.Rows[r.Digest]; ok {
+			r = prev.add(r)
+		}
+		snap.Rows[r.Digest] = r
+	}
+	if snap.Time.IsZero() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return snap, err
+		}
+		snap.Time = fi.ModTime()
+	}
+	return snap, nil
+}
+
+// Diff returns the workload between the before and after snapshots. Begin
+// and End are the snapshot times. A digest with fewer executions after than
+// before was truncated or evicted between snapshots, so its after values are
+// the difference. Min, max, and 95th percentile times are since the table was
+// truncated because they can't be diffed, and medians are averages, so the
+// result is SumsOnly: per-query metric deltas have no confidence.
+func Diff(before, after Snapshot) (slowlog.Result, error) {
+	res := slowlog.Result{
+		Begin: before.Time,
+		End:   after.Time,
+		Result: gomysql.Result{
+			Class: map[string]*gomysql.Class{},
+		},
+		SumsOnly: true,
+	}
+	if !after.Time.After(before.Time) {
+		return res, fmt.Errorf("after snapshot (%s) is not after before snapshot (%s)", after.Time, before.Time)
+	}
+	var global Row
+	for digest, a := range after.Rows {
+		b, ok := before.Rows[digest]
+		if !ok || a.Count < b.Count {
+			b = Row{} // new or truncated
+		}
+		d := a.sub(b)
+		if d.Count == 0 {
+			continue
+		}
+		global = global.add(d)
+		res.Class[d.id()] = class(d)
+	}
+	global.Quantile95 = 0 // can't be summed
+	res.Global = class(global)
+	res.Global.Id = ""
+	res.Global.Fingerprint = ""
+	res.Global.Example = nil
+	res.Global.UniqueQueries = uint(len(res.Class))
+	return res, nil
+}
+
+func (r Row) id() string {
+	if len(r.Digest) > ID_LEN {
+		return r.Digest[:ID_LEN]
+	}
+	return r.Digest
+}
+
+// add returns the sum of r and r2, which are the same digest.
+func (r Row) add(r2 Row) Row {
+	if r.Schema != r2.Schema {
+		r.Schema = ""
+	}
+	if r.DigestText == "" {
+		r.DigestText = r2.DigestText
+	}
+	if r.Count == 0 || r2.MinTimerWait < r.MinTimerWait {
+		r.MinTimerWait = r2.MinTimerWait
+	}
+	r.Count += r2.Count
+	r.TimerWait += r2.TimerWait
+	r.LockTime += r2.LockTime
+	r.RowsSent += r2.RowsSent
+	r.RowsExamined += r2.RowsExamined
+	r.TmpTables += r2.TmpTables
+	r.TmpDiskTables += r2.TmpDiskTables
+	r.SelectScan += r2.SelectScan
+	if r2.MaxTimerWait > r.MaxTimerWait {
+		r.MaxTimerWait = r2.MaxTimerWait
+	}
+	if r2.Quantile95 > r.Quantile95 {
+		r.Quantile95 = r2.Quantile95
+	}
+	if r2.SampleTimerWait > r.SampleTimerWait {
+		r.SampleText = r2.SampleText
+		r.SampleTimerWait = r2.SampleTimerWait
+	}
+	return r
+}
+
+// sub returns r minus before. Values that can't be diffed are r's.
+func (r Row) sub(before Row) Row {
+	r.Count -= before.Count
+	r.TimerWait = sub(r.TimerWait, before.TimerWait)
+	r.LockTime = sub(r.LockTime, before.LockTime)
+	r.RowsSent = sub(r.RowsSent, before.RowsSent)
+	r.RowsExamined = sub(r.RowsExamined, before.RowsExamined)
+	r.TmpTables = sub(r.TmpTables, before.TmpTables)
+	r.TmpDiskTables = sub(r.TmpDiskTables, before.TmpDiskTables)
+	r.SelectScan = sub(r.SelectScan, before.SelectScan)
+	return r
+}
+
+func sub(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// class returns the row as a class with slow log metrics.
+func class(r Row) *gomysql.Class {
+	c := &gomysql.Class{
+		Id:            r.id(),
+		Db:            r.Schema,
+		Fingerprint:   r.DigestText,
+		Metrics:       gomysql.NewMetrics(),
+		TotalQueries:  uint(r.Count),
+		UniqueQueries: 1,
+	}
+	if r.Count == 0 {
+		return c
+	}
+	c.Metrics.TimeMetrics["Query_time"] = timeStats(r.Count, r.TimerWait, r.MinTimerWait, r.Quantile95, r.MaxTimerWait)
+	c.Metrics.TimeMetrics["Lock_time"] = timeStats(r.Count, r.LockTime, 0, 0, 0)
+	c.Metrics.NumberMetrics["Rows_sent"] = numberStats(r.Count, r.RowsSent)
+	c.Metrics.NumberMetrics["Rows_examined"] = numberStats(r.Count, r.RowsExamined)
+	c.Metrics.NumberMetrics["Tmp_tables"] = numberStats(r.Count, r.TmpTables)
+	c.Metrics.NumberMetrics["Tmp_disk_tables"] = numberStats(r.Count, r.TmpDiskTables)
+	scans := r.SelectScan
+	if scans > r.Count {
+		scans = r.Count // a statement can scan more than one table
+	}
+	c.Metrics.BoolMetrics["Full_scan"] = &gomysql.BoolStats{Sum: scans}
+	if r.SampleText != "" {
+		c.Example = &gomysql.Example{
+			QueryTime: float64(r.SampleTimerWait) / TIMER_PER_SECOND,
+			Db:        r.Schema,
+			Query:     r.SampleText,
+		}
+	}
+	return c
+}
+
+// timeStats returns the stats of n timer values that sum to sum. min, p95,
+// and max are optional: zero p95 and max are the average.
+func timeStats(n, sum, min, p95, max uint64) *gomysql.TimeStats {
+	avg := float64(sum) / TIMER_PER_SECOND / float64(n)
+	s := &gomysql.TimeStats{
+		Cnt: uint(n),
+		Sum: float64(sum) / TIMER_PER_SECOND,
+		Min: float64(min) / TIMER_PER_SECOND,
+		Avg: avg,
+		Med: avg,
+		P95: float64(p95) / TIMER_PER_SECOND,
+		Max: float64(max) / TIMER_PER_SECOND,
+	}
+	if p95 == 0 {
+		s.P95 = avg
+	}
+	if max == 0 {
+		s.Max = avg
+	}
+	return s
+}
+
+func numberStats(n, sum uint64) *gomysql.NumberStats {
+	return &gomysql.NumberStats{
+		Cnt: uint(n),
+		Sum: sum,
+		Avg: sum / n,
+		Med: sum / n,
+		P95: sum / n,
+	}
+}
+
+// row returns the row of column values. Missing and NULL values are zero.
+func row(cols map[string]string) (Row, error) {
+	r := Row{
+		Digest:     cols["DIGEST"],
+		Schema:     cols["SCHEMA_NAME"],
+		DigestText: cols["DIGEST_TEXT"],
+		SampleText: cols["QUERY_SAMPLE_TEXT"],
+	}
+	for _, c := range []struct {
+		col string
+		dst *uint64
+	}{
+		{"COUNT_STAR", &r.Count},
+		{"SUM_TIMER_WAIT", &r.TimerWait},
+		{"SUM_LOCK_TIME", &r.LockTime},
+		{"SUM_ROWS_SENT", &r.RowsSent},
+		{"SUM_ROWS_EXAMINED", &r.RowsExamined},
+		{"SUM_CREATED_TMP_TABLES", &r.TmpTables},
+		{"SUM_CREATED_TMP_DISK_TABLES", &r.TmpDiskTables},
+		{"SUM_SELECT_SCAN", &r.SelectScan},
+		{"MIN_TIMER_WAIT", &r.MinTimerWait},
+		{"MAX_TIMER_WAIT", &r.MaxTimerWait},
+		{"QUANTILE_95", &r.Quantile95},
+		{"QUERY_SAMPLE_TIMER_WAIT", &r.SampleTimerWait},
+	} {
+		v := cols[c.col]
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return r, fmt.Errorf("invalid %s: %s", c.col, v)
+		}
+		*c.dst = n
+	}
+	return r, nil
+}
+
+// readTSV returns the rows of tab-separated values. If the first line is not
+// column names, the columns are COLUMNS.
+func readTSV(data []byte) ([]map[string]string, error) {
+	rows := []map[string]string{}
+	var header []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024) // long DIGEST_TEXT
+	for s.Scan() {
+		line := strings.TrimSuffix(s.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		vals := strings.Split(line, "\t")
+		if header == nil {
+			if knownColumns(vals) {
+				header = vals
+				continue
+			}
+			header = COLUMNS
+		}
+		cols := map[string]string{}
+		for i, v := range vals {
+			if i < len(header) {
+				cols[header[i]] = unescape(v)
+			}
+		}
+		rows = append(rows, cols)
+	}
+	return rows, s.Err()
+}
+
+func knownColumns(vals []string) bool {
+	for _, v := range vals {
+		if v == "DIGEST" {
+			return true
+		}
+	}
+	return false
+}
+
+// unescape returns the value without mysql -B and INTO OUTFILE escapes. NULL
+// is empty.
+func unescape(v string) string {
+	if v == "NULL" || v == `\N` {
+		return ""
+	}
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	return strings.NewReplacer(`\t`, "\t", `\n`, "\n", `\0`, "\x00", `\\`, `\`).Replace(v)
+}
+
+// readJSON returns the rows of a JSON array of objects or stream of objects.
+// Values can be strings or numbers. null is empty.
+func readJSON(data []byte) ([]map[string]string, error) {
+	rows := []map[string]string{}
+	add := func(obj map[string]interface{}) {
+		cols := map[string]string{}
+		for k, v := range obj {
+			switch v := v.(type) {
+			case string:
+				cols[k] = v
+			case json.Number:
+				cols[k] = v.String()
+			}
+		}
+		rows = append(rows, cols)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			for _, obj := range v {
+				o, ok := obj.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("array value is not an object")
+				}
+				add(o)
+			}
+		case map[string]interface{}:
+			add(v)
+		default:
+			return nil, fmt.Errorf("value is not an array or object")
+		}
+	}
+	return rows, nil
+}
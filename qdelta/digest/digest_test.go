@@ -0,0 +1,100 @@
+package digest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/digest"
+	"github.com/go-test/deep"
+)
+
+func TestRead(t *testing.T) {
+	tsv, err := digest.Read("../test/digests/001-comp.tsv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, err := digest.Read("../test/digests/001-comp.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(json, tsv); diff != nil {
+		t.Error(diff)
+	}
+
+	if tsv.Time != time.Date(2017, 1, 1, 0, 10, 0, 0, time.UTC) {
+		t.Errorf("got snapshot time %s", tsv.Time)
+	}
+	// NULL digest is ignored, digest in two schemas is summed
+	if len(tsv.Rows) != 4 {
+		t.Errorf("got %d rows, expected 4", len(tsv.Rows))
+	}
+	b := tsv.Rows["7c1e9f0a2b4d6e8f0a1c3e5a7b9d1f3a5c7e9b1d3f5a7c9e1b3d5f7a9c1e3b5d"]
+	if b.Count != 1100 || b.Schema != "" {
+		t.Errorf("got count %d schema '%s', expected count 1100 schema ''", b.Count, b.Schema)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before, err := digest.Read("../test/digests/001-base.tsv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := digest.Read("../test/digests/001-comp.tsv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := digest.Diff(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.End.Sub(res.Begin) != 10*time.Minute {
+		t.Errorf("got duration %s, expected 10m", res.End.Sub(res.Begin))
+	}
+	got := map[string]uint{}
+	for id, class := range res.Class {
+		got[id] = class.TotalQueries
+	}
+	expect := map[string]uint{
+		"3ad2e5c8a8e4f0b1": 60000, // 100 QPS
+		"7c1e9f0a2b4d6e8f": 600,   // new in schema app2
+		"c4f2a0e8d6b4c2a0": 300,   // truncated between snapshots
+		"e91b3c5d7f9a1b3c": 60,    // new
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+	if res.Global.TotalQueries != 60960 || res.Global.UniqueQueries != 4 {
+		t.Errorf("got global %d queries, %d unique, expected 60960 and 4", res.Global.TotalQueries, res.Global.UniqueQueries)
+	}
+
+	a := res.Class["3ad2e5c8a8e4f0b1"]
+	if a.Fingerprint != "SELECT * FROM `t` WHERE `id` = ?" || a.Db != "app" {
+		t.Errorf("got fingerprint '%s' db '%s'", a.Fingerprint, a.Db)
+	}
+	qt := a.Metrics.TimeMetrics["Query_time"]
+	if qt.Sum != 120 || qt.Avg != 0.002 || qt.Max != 0.009 {
+		t.Errorf("got Query_time sum %f avg %f max %f, expected 120, 0.002, 0.009", qt.Sum, qt.Avg, qt.Max)
+	}
+	if s := a.Metrics.TimeMetrics["Lock_time"].Sum; s != 6 {
+		t.Errorf("got Lock_time sum %f, expected 6", s)
+	}
+	if s := res.Class["c4f2a0e8d6b4c2a0"].Metrics.BoolMetrics["Full_scan"].Sum; s != 300 {
+		t.Errorf("got Full_scan %d, expected 300", s)
+	}
+
+	// Works like a slow log result
+	metrics := delta.Merge(res, res)
+	if qps := metrics["3ad2e5c8a8e4f0b1"].Comp.QPS; qps != 100 {
+		t.Errorf("got QPS %f, expected 100", qps)
+	}
+
+	if !res.SumsOnly {
+		t.Error("result is not SumsOnly")
+	}
+
+	if _, err := digest.Diff(after, before); err == nil {
+		t.Error("no error for after snapshot before before snapshot")
+	}
+}
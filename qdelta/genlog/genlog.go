@@ -0,0 +1,180 @@
+// Package genlog parses MySQL general logs. The general log doesn't have
+// query times or other metrics, only when each query was received, so results
+// from it only have counts: QPS and count deltas, but not load or exec time.
+package genlog
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-mysql/slowlog"
+)
+
+// COMMANDS are the general log commands. Only Query and Execute are events,
+// but every command ends the previous multi-line query.
+var COMMANDS = []string{
+	"Query", "Execute", "Prepare", "Close stmt", "Reset stmt", "Long Data", "Fetch",
+	"Connect", "Connect Out", "Quit", "Init DB", "Change user", "Reset Connection",
+	"Field List", "Create DB", "Drop DB", "Refresh", "Shutdown", "Statistics",
+	"Processlist", "Kill", "Debug", "Ping", "Time", "Delayed insert", "Sleep",
+	"Binlog Dump GTID", "Binlog Dump", "Table Dump", "Register Slave", "Set option",
+	"Daemon", "Clone", "Error",
+}
+
+var (
+	// 2017-01-01T00:00:00.123456Z\t    5 Query\tSELECT 1 (MySQL 5.7 and newer)
+	// 170101  0:00:00\t    5 Query\tSELECT 1 (MySQL 5.6 and older, ts optional)
+	entryRe = regexp.MustCompile(`^([^\t]*)\t+ *(\d+) (` + strings.Join(COMMANDS, "|") + `)(?:\t(.*))?$`)
+
+	// Written when mysqld starts or the log is flushed
+	headerRe = regexp.MustCompile(`^(\S+, Version: |Tcp port: |Time\s+Id\s+Command)`)
+
+	// Connect argument: root@localhost on test using Socket
+	connectRe = regexp.MustCompile(`^(\S*)@(\S*) (?:as \S+ )?on ?(\S*)`)
+)
+
+// Parser parses a general log into events with a Query (or prepared statement
+// Execute), its connection's user, host, and db, and a ts like the slow log.
+// Events before the first ts don't have one. It implements the slow log
+// Parser interface.
+type Parser struct {
+	file   *os.File
+	events chan slowlog.Event
+	stop   chan struct{}
+	once   sync.Once
+	err    error
+
+	conns  map[string]*conn // connection ID => conn
+	lastTs string           // MySQL 5.6 only logs ts when it changes
+}
+
+type conn struct {
+	user string
+	host string
+	db   string
+}
+
+func NewParser(file *os.File) *Parser {
+	return &Parser{
+		file:   file,
+		events: make(chan slowlog.Event),
+		stop:   make(chan struct{}),
+		conns:  map[string]*conn{},
+	}
+}
+
+// Start starts parsing the file at its current offset. The only option is
+// StartOffset.
+func (p *Parser) Start(opt slowlog.Options) error {
+	if opt.StartOffset > 0 {
+		if _, err := p.file.Seek(int64(opt.StartOffset), io.SeekStart); err != nil {
+			return err
+		}
+	}
+	go p.run(opt.StartOffset)
+	return nil
+}
+
+// Events returns the channel on which events are sent. It's closed when
+// the whole file is parsed or Stop is called.
+func (p *Parser) Events() <-chan slowlog.Event {
+	return p.events
+}
+
+func (p *Parser) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+// Error returns the error reading the file, if any, after Events is closed.
+func (p *Parser) Error() error {
+	return p.err
+}
+
+func (p *Parser) run(offset uint64) {
+	defer close(p.events)
+	r := bufio.NewReader(p.file)
+	var e *slowlog.Event // query, maybe continued on the next lines
+	send := func(end uint64) bool {
+		if e == nil {
+			return true
+		}
+		e.OffsetEnd = end
+		e.Query = strings.TrimSpace(e.Query)
+		select {
+		case p.events <- *e:
+		case <-p.stop:
+			return false
+		}
+		e = nil
+		return true
+	}
+	for {
+		line, err := r.ReadString('\n')
+		lineOffset := offset
+		offset += uint64(len(line))
+		if l := strings.TrimRight(line, "\r\n"); l != "" {
+			if m := entryRe.FindStringSubmatch(l); m != nil {
+				if !send(lineOffset) {
+					return
+				}
+				e = p.entry(strings.TrimSpace(m[1]), m[2], m[3], m[4])
+				if e != nil {
+					e.Offset = lineOffset
+				}
+			} else if headerRe.MatchString(l) {
+				if !send(lineOffset) {
+					return
+				}
+			} else if e != nil {
+				e.Query += "\n" + l // multi-line query
+			}
+		}
+		if err != nil {
+			if send(offset) && err != io.EOF {
+				p.err = err
+			}
+			return
+		}
+	}
+}
+
+// entry returns the event for a Query or Execute entry, else it updates the
+// connection and returns nil.
+func (p *Parser) entry(ts, id, command, arg string) *slowlog.Event {
+	if ts != "" {
+		p.lastTs = ts
+	}
+	c, ok := p.conns[id]
+	if !ok {
+		c = &conn{} // connected before the log started
+		p.conns[id] = c
+	}
+	switch command {
+	case "Connect":
+		if m := connectRe.FindStringSubmatch(arg); m != nil {
+			c.user, c.host, c.db = m[1], m[2], m[3]
+		}
+	case "Init DB":
+		c.db = arg
+	case "Change user":
+		p.conns[id] = &conn{}
+	case "Quit":
+		delete(p.conns, id)
+	case "Query", "Execute":
+		if use := strings.TrimSpace(arg); len(use) > 4 && strings.EqualFold(use[:4], "use ") {
+			c.db = strings.Trim(strings.TrimSuffix(strings.TrimSpace(use[4:]), ";"), "`")
+		}
+		e := slowlog.NewEvent()
+		e.Ts = p.lastTs
+		e.Query = arg
+		e.User = c.user
+		e.Host = c.host
+		e.Db = c.db
+		return e
+	}
+	return nil
+}
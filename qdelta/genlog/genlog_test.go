@@ -0,0 +1,66 @@
+package genlog_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/genlog"
+	"github.com/go-mysql/slowlog"
+	"github.com/go-test/deep"
+)
+
+type event struct {
+	Ts    string
+	Query string
+	User  string
+	Host  string
+	Db    string
+}
+
+func parse(t *testing.T, file string) []event {
+	fd, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	p := genlog.NewParser(fd)
+	if err := p.Start(slowlog.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	got := []event{}
+	for e := range p.Events() {
+		got = append(got, event{e.Ts, e.Query, e.User, e.Host, e.Db})
+	}
+	if err := p.Error(); err != nil {
+		t.Error(err)
+	}
+	return got
+}
+
+func TestParse57(t *testing.T) {
+	got := parse(t, "../test/genlogs/general-5.7.log")
+	expect := []event{
+		{"2017-01-01T00:00:00.000200Z", "SELECT * FROM orders WHERE id = 1", "app", "10.0.0.1", "shop"},
+		{"2017-01-01T00:00:00.500000Z", "SELECT * FROM orders WHERE id = 2", "", "", ""}, // connected before log
+		{"2017-01-01T00:00:01.000100Z", "SELECT c\nFROM items\nWHERE id = 3", "app", "10.0.0.1", "inventory"},
+		{"2017-01-01T00:00:02.000100Z", "SELECT * FROM orders WHERE id = 4", "", "", ""}, // Execute, not Prepare
+		{"2017-01-01T00:00:03.000100Z", "use shop", "root", "localhost", "shop"},
+		{"2017-01-01T00:00:03.000200Z", "SELECT * FROM orders WHERE id = 5", "root", "localhost", "shop"},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestParse56(t *testing.T) {
+	got := parse(t, "../test/genlogs/general-5.6.log")
+	expect := []event{
+		{"170101  0:00:00", "SELECT * FROM orders WHERE id = 1", "app", "10.0.0.1", "shop"}, // ts of Connect
+		{"170101  0:00:00", "SELECT * FROM orders WHERE id = 2", "", "", ""},
+		{"170101  0:00:01", "SELECT c\nFROM items\nWHERE id = 3", "app", "10.0.0.1", "inventory"},
+		{"170101  0:00:02", "SELECT * FROM orders WHERE id = 4", "", "", ""},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,151 @@
+// Package openmetrics writes results as an OpenMetrics text exposition so
+// Prometheus can scrape slow log workload, e.g. rate(qdelta_queries_total[5m]).
+package openmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	gomysql "github.com/go-mysql/slowlog"
+)
+
+const CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Write writes per-query and global query count, exec time sum, and QPS,
+// scaled by the sampling rate (see slowlog.Result.Rate and ClassRate).
+// Counts and sums are from res, and QPS is from recent, which is usually res
+// too, or the last bucket when following a slow log. Queries are labeled by
+// id and fingerprint truncated to fingerprintLen characters (0 is no limit).
+func Write(w io.Writer, res, recent slowlog.Result, fingerprintLen int) error {
+	buf := bufio.NewWriter(w)
+
+	ids := make([]string, 0, len(res.Class))
+	for id := range res.Class {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	labels := make([]string, len(ids))
+	for n, id := range ids {
+		labels[n] = fmt.Sprintf(`{id="%s",fingerprint="%s"}`, escape(id), escape(truncate(res.Class[id].Fingerprint, fingerprintLen)))
+	}
+
+	fmt.Fprintln(buf, "# TYPE qdelta_queries counter")
+	fmt.Fprintln(buf, "# HELP qdelta_queries Number of queries.")
+	for n, id := range ids {
+		fmt.Fprintf(buf, "qdelta_queries_total%s %s\n", labels[n], ftoa(float64(res.Class[id].TotalQueries)*res.ClassRate(id)))
+	}
+	fmt.Fprintln(buf, "# TYPE qdelta_query_time_seconds counter")
+	fmt.Fprintln(buf, "# UNIT qdelta_query_time_seconds seconds")
+	fmt.Fprintln(buf, "# HELP qdelta_query_time_seconds Sum of query execution time.")
+	for n, id := range ids {
+		fmt.Fprintf(buf, "qdelta_query_time_seconds_total%s %s\n", labels[n], ftoa(queryTime(res.Class[id])*res.ClassRate(id)))
+	}
+	fmt.Fprintln(buf, "# TYPE qdelta_qps gauge")
+	fmt.Fprintln(buf, "# HELP qdelta_qps Queries per second.")
+	d := recent.End.Sub(recent.Begin).Seconds()
+	for n, id := range ids {
+		var qps float64
+		if c, ok := recent.Class[id]; ok && d > 0 {
+			qps = float64(c.TotalQueries) * recent.ClassRate(id) / d
+		}
+		fmt.Fprintf(buf, "qdelta_qps%s %s\n", labels[n], ftoa(qps))
+	}
+
+	// Global totals, separate so sum() of the per-query metrics isn't doubled
+	var total, totalTime, qps float64
+	if res.Global != nil {
+		total = float64(res.Global.TotalQueries) * res.Rate()
+		totalTime = queryTime(res.Global) * res.Rate()
+	}
+	if recent.Global != nil && d > 0 {
+		qps = float64(recent.Global.TotalQueries) * recent.Rate() / d
+	}
+	fmt.Fprintln(buf, "# TYPE qdelta_global_queries counter")
+	fmt.Fprintln(buf, "# HELP qdelta_global_queries Number of queries.")
+	fmt.Fprintf(buf, "qdelta_global_queries_total %s\n", ftoa(total))
+	fmt.Fprintln(buf, "# TYPE qdelta_global_query_time_seconds counter")
+	fmt.Fprintln(buf, "# UNIT qdelta_global_query_time_seconds seconds")
+	fmt.Fprintln(buf, "# HELP qdelta_global_query_time_seconds Sum of query execution time.")
+	fmt.Fprintf(buf, "qdelta_global_query_time_seconds_total %s\n", ftoa(totalTime))
+	fmt.Fprintln(buf, "# TYPE qdelta_global_qps gauge")
+	fmt.Fprintln(buf, "# HELP qdelta_global_qps Queries per second.")
+	fmt.Fprintf(buf, "qdelta_global_qps %s\n", ftoa(qps))
+
+	fmt.Fprintln(buf, "# EOF")
+	return buf.Flush()
+}
+
+// Exporter serves the running total of results added to it, e.g. every
+// bucket from slowlog.Processor.Stream, so counters only increase.
+type Exporter struct {
+	fingerprintLen int
+
+	mu     sync.Mutex
+	total  slowlog.Result
+	recent slowlog.Result
+}
+
+func NewExporter(fingerprintLen int) *Exporter {
+	return &Exporter{
+		fingerprintLen: fingerprintLen,
+		total:          slowlog.Combine(),
+	}
+}
+
+// Add adds res to the total. QPS is from the last res added.
+func (e *Exporter) Add(res slowlog.Result) {
+	total := slowlog.Combine(e.total, res)
+	e.mu.Lock()
+	e.total = total
+	e.recent = res
+	e.mu.Unlock()
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	total, recent := e.total, e.recent
+	e.mu.Unlock()
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	if err := Write(w, total, recent, e.fingerprintLen); err != nil {
+		// Too late for an error status; the response is partly written
+		log.Printf("cannot write metrics (recovering): %s", err)
+	}
+}
+
+func queryTime(class *gomysql.Class) float64 {
+	if class.Metrics == nil {
+		return 0
+	}
+	if s, ok := class.Metrics.TimeMetrics["Query_time"]; ok {
+		return s.Sum
+	}
+	return 0
+}
+
+// truncate truncates s to n characters (not bytes), if n > 0.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 || len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// escape escapes a label value: backslash, double quote, and newline.
+func escape(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func ftoa(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,90 @@
+package openmetrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/openmetrics"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	"github.com/go-test/deep"
+)
+
+func TestWrite001(t *testing.T) {
+	res, err := slowlog.Load("../test/results/001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Class["A"].Fingerprint = "select \"a\"\nfrom a"
+
+	var buf bytes.Buffer
+	if err := openmetrics.Write(&buf, res, res, 12); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# TYPE qdelta_queries counter
+# HELP qdelta_queries Number of queries.
+qdelta_queries_total{id="A",fingerprint="select \"a\"\nf"} 200000
+qdelta_queries_total{id="B",fingerprint="query b"} 140000
+qdelta_queries_total{id="C",fingerprint="query c"} 20000
+# TYPE qdelta_query_time_seconds counter
+# UNIT qdelta_query_time_seconds seconds
+# HELP qdelta_query_time_seconds Sum of query execution time.
+qdelta_query_time_seconds_total{id="A",fingerprint="select \"a\"\nf"} 3600
+qdelta_query_time_seconds_total{id="B",fingerprint="query b"} 7200
+qdelta_query_time_seconds_total{id="C",fingerprint="query c"} 3600
+# TYPE qdelta_qps gauge
+# HELP qdelta_qps Queries per second.
+qdelta_qps{id="A",fingerprint="select \"a\"\nf"} 55.55555555555556
+qdelta_qps{id="B",fingerprint="query b"} 38.888888888888886
+qdelta_qps{id="C",fingerprint="query c"} 5.555555555555555
+# TYPE qdelta_global_queries counter
+# HELP qdelta_global_queries Number of queries.
+qdelta_global_queries_total 360000
+# TYPE qdelta_global_query_time_seconds counter
+# UNIT qdelta_global_query_time_seconds seconds
+# HELP qdelta_global_query_time_seconds Sum of query execution time.
+qdelta_global_query_time_seconds_total 14400
+# TYPE qdelta_global_qps gauge
+# HELP qdelta_global_qps Queries per second.
+qdelta_global_qps 100
+# EOF
+`
+	if diff := deep.Equal(strings.Split(buf.String(), "\n"), strings.Split(expect, "\n")); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestExporter(t *testing.T) {
+	res, err := slowlog.Load("../test/results/001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counters are the running total, QPS is the last result
+	e := openmetrics.NewExporter(0)
+	e.Add(res)
+	e.Add(res)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	got := []string{w.Header().Get("Content-Type")}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "qdelta_global_") {
+			got = append(got, line)
+		}
+	}
+	expect := []string{
+		openmetrics.CONTENT_TYPE,
+		"qdelta_global_queries_total 720000",
+		"qdelta_global_query_time_seconds_total 28800",
+		"qdelta_global_qps 100",
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
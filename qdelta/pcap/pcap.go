@@ -0,0 +1,614 @@
+// Package pcap parses MySQL queries and their response times from packet
+// captures (tcpdump -w) of the MySQL client/server protocol. Query_time is
+// from the client's query to the last packet of the server's response, so it
+// includes network latency.
+//
+// Only text protocol queries (COM_QUERY) are events, not prepared statements,
+// and connections using TLS cannot be decoded.
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql/slowlog"
+)
+
+// DEFAULT_PORT is the default MySQL server port.
+const DEFAULT_PORT = 3306
+
+// TS_FORMAT is the event ts format, like the MySQL 5.7 slow log. Packet times
+// are UTC.
+const TS_FORMAT = "2006-01-02T15:04:05.000000Z07:00"
+
+// Link-layer header types
+const (
+	LINKTYPE_NULL      = 0
+	LINKTYPE_ETHERNET  = 1
+	LINKTYPE_RAW       = 101
+	LINKTYPE_LINUX_SLL = 113
+	LINKTYPE_IPV4      = 228
+	LINKTYPE_IPV6      = 229
+	LINKTYPE_SLL2      = 276
+)
+
+// MySQL protocol
+const (
+	COM_QUIT    = 0x01
+	COM_INIT_DB = 0x02
+	COM_QUERY   = 0x03
+
+	CLIENT_CONNECT_WITH_DB          = 0x00000008
+	CLIENT_SSL                      = 0x00000800
+	CLIENT_SECURE_CONNECTION        = 0x00008000
+	CLIENT_PLUGIN_AUTH_LENENC_DATA  = 0x00200000
+	SERVER_MORE_RESULTS_EXISTS      = 0x0008
+	MAX_PACKET_LEN                  = 0xffffff
+	PROTOCOL_VERSION                = 10
+	HANDSHAKE_RESPONSE_HEADER_LEN   = 32 // caps, max packet, charset, filler
+	HANDSHAKE_RESPONSE_MIN_USER_LEN = HANDSHAKE_RESPONSE_HEADER_LEN + 1
+)
+
+// Parser parses a pcap file into query events with Query_time, Rows_sent
+// (result sets), and Rows_affected (OK), and the connection's user and db
+// if the capture has the connection handshake. Events are sent when the
+// response ends, so they're not strictly in ts order. It implements the slow
+// log Parser interface.
+type Parser struct {
+	file   *os.File
+	port   uint16
+	events chan slowlog.Event
+	stop   chan struct{}
+	once   sync.Once
+	err    error
+
+	order  binary.ByteOrder
+	nano   bool // ns timestamps, else µs
+	link   uint32
+	offset uint64
+	conns  map[string]*conn // client ip:port => conn
+}
+
+// NewParser returns a parser of MySQL traffic to and from port, usually
+// DEFAULT_PORT.
+func NewParser(file *os.File, port int) *Parser {
+	return &Parser{
+		file:   file,
+		port:   uint16(port),
+		events: make(chan slowlog.Event),
+		stop:   make(chan struct{}),
+		conns:  map[string]*conn{},
+	}
+}
+
+// Start reads the pcap file header and starts parsing packets. Options are
+// ignored because the file must be read from the beginning.
+func (p *Parser) Start(opt slowlog.Options) error {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(p.file, hdr); err != nil {
+		return fmt.Errorf("cannot read pcap file header: %s", err)
+	}
+	switch binary.LittleEndian.Uint32(hdr) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return fmt.Errorf("pcapng files are not supported, convert to pcap: editcap -F pcap in.pcapng out.pcap")
+	default:
+		return fmt.Errorf("not a pcap file: invalid magic number %x", hdr[:4])
+	}
+	p.link = p.order.Uint32(hdr[20:]) & 0x0fffffff
+	switch p.link {
+	case LINKTYPE_NULL, LINKTYPE_ETHERNET, LINKTYPE_RAW, LINKTYPE_LINUX_SLL, LINKTYPE_IPV4, LINKTYPE_IPV6, LINKTYPE_SLL2:
+	default:
+		return fmt.Errorf("unsupported pcap link type: %d", p.link)
+	}
+	p.offset = 24
+	go p.run()
+	return nil
+}
+
+// Events returns the channel on which events are sent. It's closed when
+// the whole file is parsed or Stop is called.
+func (p *Parser) Events() <-chan slowlog.Event {
+	return p.events
+}
+
+func (p *Parser) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+// Error returns the error reading the file, if any, after Events is closed.
+func (p *Parser) Error() error {
+	return p.err
+}
+
+func (p *Parser) run() {
+	defer close(p.events)
+	hdr := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(p.file, hdr); err != nil {
+			if err != io.EOF {
+				p.err = fmt.Errorf("cannot read packet header at offset %d: %s", p.offset, err)
+			}
+			break
+		}
+		sec := p.order.Uint32(hdr[0:])
+		frac := p.order.Uint32(hdr[4:])
+		capLen := p.order.Uint32(hdr[8:])
+		if capLen > 256*1024*1024 {
+			p.err = fmt.Errorf("invalid packet length %d at offset %d", capLen, p.offset)
+			break
+		}
+		data := make([]byte, capLen)
+		if _, err := io.ReadFull(p.file, data); err != nil {
+			p.err = fmt.Errorf("cannot read packet at offset %d: %s", p.offset, err)
+			break
+		}
+		p.offset += 16 + uint64(capLen)
+		if !p.nano {
+			frac *= 1000
+		}
+		ts := time.Unix(int64(sec), int64(frac)).UTC()
+		if !p.packet(ts, data) {
+			return // stopped
+		}
+	}
+	// End of capture: responses in progress end at their last packet
+	for _, c := range p.conns {
+		if !p.send(c) {
+			return
+		}
+	}
+}
+
+// packet decodes the link, IP, and TCP layers of a captured packet and
+// handles its payload. It returns false if the parser is stopped.
+func (p *Parser) packet(ts time.Time, data []byte) bool {
+	var proto uint16 // ethertype
+	switch p.link {
+	case LINKTYPE_ETHERNET:
+		if len(data) < 14 {
+			return true
+		}
+		proto, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for (proto == 0x8100 || proto == 0x88a8) && len(data) >= 4 { // VLAN
+			proto, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case LINKTYPE_LINUX_SLL:
+		if len(data) < 16 {
+			return true
+		}
+		proto, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case LINKTYPE_SLL2:
+		if len(data) < 20 {
+			return true
+		}
+		proto, data = binary.BigEndian.Uint16(data[0:]), data[20:]
+	case LINKTYPE_NULL:
+		if len(data) < 4 {
+			return true
+		}
+		// Address family in the capturing host's byte order
+		family := p.order.Uint32(data)
+		if family == 2 {
+			proto = 0x0800
+		} else if family == 24 || family == 28 || family == 30 {
+			proto = 0x86dd
+		}
+		data = data[4:]
+	default: // raw IP
+		if len(data) > 0 && data[0]>>4 == 4 {
+			proto = 0x0800
+		} else if len(data) > 0 && data[0]>>4 == 6 {
+			proto = 0x86dd
+		}
+	}
+
+	var src, dst string
+	switch proto {
+	case 0x0800: // IPv4
+		if len(data) < 20 || data[9] != 6 {
+			return true // not TCP
+		}
+		if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 {
+			return true // fragment
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if ihl < 20 || total < ihl || len(data) < ihl {
+			return true
+		}
+		if total < len(data) {
+			data = data[:total] // Ethernet padding
+		}
+		src, dst = ip(data[12:16]), ip(data[16:20])
+		data = data[ihl:]
+	case 0x86dd: // IPv6, without extension headers
+		if len(data) < 40 || data[6] != 6 {
+			return true
+		}
+		if total := 40 + int(binary.BigEndian.Uint16(data[4:])); total < len(data) {
+			data = data[:total]
+		}
+		src, dst = ip(data[8:24]), ip(data[24:40])
+		data = data[40:]
+	default:
+		return true
+	}
+
+	// TCP
+	if len(data) < 20 {
+		return true
+	}
+	srcPort := binary.BigEndian.Uint16(data[0:])
+	dstPort := binary.BigEndian.Uint16(data[2:])
+	seq := binary.BigEndian.Uint32(data[4:])
+	flags := data[13]
+	off := int(data[12]>>4) * 4
+	if off < 20 || len(data) < off {
+		return true
+	}
+	payload := data[off:]
+
+	var key, host string
+	var fromClient bool
+	switch {
+	case dstPort == p.port:
+		key, host, fromClient = src+":"+strconv.Itoa(int(srcPort)), src, true
+	case srcPort == p.port:
+		key, host = dst+":"+strconv.Itoa(int(dstPort)), dst
+	default:
+		return true
+	}
+	c, ok := p.conns[key]
+	if !ok {
+		if len(payload) == 0 && flags&0x02 == 0 {
+			return true // e.g. last ACK after FIN
+		}
+		c = &conn{host: strings.Trim(host, "[]")}
+		p.conns[key] = c
+	}
+	s := &c.server
+	if fromClient {
+		s = &c.client
+	}
+	if flags&0x02 != 0 { // SYN
+		s.next, s.synced = seq+1, true
+		s.buf = nil
+		return true
+	}
+	if !s.add(seq, payload) {
+		c.event, c.state = nil, IDLE // response incomplete
+	}
+	for {
+		pkt, seqId, ok := s.packet()
+		if !ok {
+			break
+		}
+		var sent bool
+		if fromClient {
+			sent = p.client(c, ts, pkt, seqId)
+		} else {
+			sent = p.server(c, ts, pkt, seqId)
+		}
+		if !sent {
+			return false
+		}
+	}
+	if flags&0x05 != 0 { // FIN or RST
+		delete(p.conns, key)
+		return p.send(c)
+	}
+	return true
+}
+
+func ip(b []byte) string {
+	if len(b) == 4 {
+		return fmt.Sprintf("%d.%d.%d.%d", b[0], b[1], b[2], b[3])
+	}
+	parts := make([]string, 8)
+	for i := range parts {
+		parts[i] = strconv.FormatUint(uint64(binary.BigEndian.Uint16(b[i*2:])), 16)
+	}
+	return "[" + strings.Join(parts, ":") + "]"
+}
+
+// stream is one direction of a TCP connection: its MySQL packets in order.
+type stream struct {
+	buf    []byte
+	next   uint32 // next TCP seq
+	synced bool
+}
+
+// add adds a TCP segment to the stream. Retransmitted data is ignored. If data
+// is missing (not captured), it returns false and the stream resumes at this
+// segment, presumably the start of a MySQL packet.
+func (s *stream) add(seq uint32, data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	end := seq + uint32(len(data))
+	lost := false
+	if s.synced {
+		d := int32(s.next - seq) // bytes already seen, wraps
+		switch {
+		case d >= int32(len(data)):
+			return true // retransmission
+		case d > 0:
+			data = data[d:]
+		case d < 0:
+			s.buf, lost = nil, true
+		}
+	}
+	s.buf = append(s.buf, data...)
+	s.next, s.synced = end, true
+	return !lost
+}
+
+// packet returns the next complete MySQL packet payload and sequence ID.
+func (s *stream) packet() ([]byte, byte, bool) {
+	if len(s.buf) < 4 {
+		return nil, 0, false
+	}
+	n := int(s.buf[0]) | int(s.buf[1])<<8 | int(s.buf[2])<<16
+	if len(s.buf) < 4+n {
+		return nil, 0, false
+	}
+	pkt, seqId := s.buf[4:4+n], s.buf[3]
+	s.buf = s.buf[4+n:]
+	if len(s.buf) == 0 {
+		s.buf = nil // don't keep large packets
+	}
+	return pkt, seqId, true
+}
+
+// Response states
+const (
+	IDLE        = iota // no query, or query response done
+	FIRST              // waiting for first response packet
+	COLUMNS            // column definitions
+	COLUMNS_END        // EOF after column definitions (not CLIENT_DEPRECATE_EOF)
+	ROWS               // rows until EOF or OK
+)
+
+// conn is one client connection.
+type conn struct {
+	client stream
+	server stream
+
+	host      string
+	user      string
+	db        string
+	handshake bool // server sent handshake, expecting client response
+	tls       bool // can't decode
+
+	state int
+	event *slowlog.Event // query in progress, nil if IDLE
+	start time.Time      // query sent
+	end   time.Time      // last response packet
+	cols  uint64         // column definitions left
+	rows  uint64
+}
+
+// client handles a client packet. Commands have sequence ID 0.
+func (p *Parser) client(c *conn, ts time.Time, pkt []byte, seqId byte) bool {
+	if c.tls {
+		return true
+	}
+	if c.handshake && seqId == 1 {
+		c.handshake = false
+		c.handshakeResponse(pkt)
+		return true
+	}
+	if seqId != 0 || len(pkt) == 0 {
+		return true // auth or LOAD DATA LOCAL INFILE data
+	}
+	if !p.send(c) { // previous query without a complete response
+		return false
+	}
+	switch pkt[0] {
+	case COM_QUERY:
+		q := pkt[1:]
+		if len(q) >= 2 && q[0] == 0x00 && q[1] == 0x01 {
+			q = q[2:] // CLIENT_QUERY_ATTRIBUTES without attributes
+		}
+		e := slowlog.NewEvent()
+		e.Offset = p.offset
+		e.Ts = ts.Format(TS_FORMAT)
+		e.Query = string(q)
+		e.User = c.user
+		e.Host = c.host
+		e.Db = c.db
+		if t := strings.TrimSpace(e.Query); len(t) > 4 && strings.EqualFold(t[:4], "use ") {
+			c.db = strings.Trim(strings.TrimSuffix(strings.TrimSpace(t[4:]), ";"), "`")
+		}
+		c.event, c.start, c.end, c.state, c.rows = e, ts, ts, FIRST, 0
+	case COM_INIT_DB:
+		c.db = string(pkt[1:])
+	case COM_QUIT:
+		c.state = IDLE
+	}
+	return true
+}
+
+// handshakeResponse sets the user and db from the client handshake
+// response (protocol 4.1), unless it's an SSL request.
+func (c *conn) handshakeResponse(pkt []byte) {
+	if len(pkt) < 4 {
+		return
+	}
+	caps := binary.LittleEndian.Uint32(pkt)
+	if caps&CLIENT_SSL != 0 && len(pkt) == HANDSHAKE_RESPONSE_HEADER_LEN {
+		c.tls = true
+		return
+	}
+	if len(pkt) < HANDSHAKE_RESPONSE_MIN_USER_LEN {
+		return
+	}
+	rest := pkt[HANDSHAKE_RESPONSE_HEADER_LEN:]
+	user, rest := nullString(rest)
+	c.user = user
+	if caps&CLIENT_CONNECT_WITH_DB == 0 || len(rest) == 0 {
+		return
+	}
+	// Skip auth response
+	switch {
+	case caps&CLIENT_PLUGIN_AUTH_LENENC_DATA != 0:
+		n, size := lenenc(rest)
+		if size == 0 || uint64(len(rest)) < uint64(size)+n {
+			return
+		}
+		rest = rest[uint64(size)+n:]
+	case caps&CLIENT_SECURE_CONNECTION != 0:
+		n := int(rest[0])
+		if len(rest) < 1+n {
+			return
+		}
+		rest = rest[1+n:]
+	default:
+		_, rest = nullString(rest)
+	}
+	c.db, _ = nullString(rest)
+}
+
+// server handles a server packet: the handshake or a query response.
+func (p *Parser) server(c *conn, ts time.Time, pkt []byte, seqId byte) bool {
+	if c.tls || len(pkt) == 0 {
+		return true
+	}
+	if c.state == IDLE {
+		if seqId == 0 && pkt[0] == PROTOCOL_VERSION {
+			c.handshake = true // new connection
+		}
+		return true
+	}
+	c.end = ts
+	switch c.state {
+	case FIRST:
+		switch pkt[0] {
+		case 0x00: // OK
+			affected, n := lenenc(pkt[1:])
+			c.event.NumberMetrics["Rows_affected"] += affected
+			if ok := pkt[1+n:]; len(ok) > 0 {
+				_, m := lenenc(ok) // last insert id
+				c.done(ok[m:])
+			} else {
+				c.state = IDLE
+			}
+		case 0xff: // ERR
+			c.state = IDLE
+		case 0xfb: // LOAD DATA LOCAL INFILE: client sends file, server sends OK
+		default: // result set column count
+			c.cols, _ = lenenc(pkt)
+			c.state = COLUMNS
+		}
+	case COLUMNS:
+		c.cols--
+		if c.cols == 0 {
+			c.state = COLUMNS_END
+		}
+	case COLUMNS_END:
+		c.state = ROWS
+		if pkt[0] == 0xfe && len(pkt) == 5 {
+			break // EOF, so rows are next
+		}
+		fallthrough // CLIENT_DEPRECATE_EOF: no EOF, so this is a row or the end
+	case ROWS:
+		switch {
+		case pkt[0] == 0xfe && len(pkt) < MAX_PACKET_LEN: // EOF or OK
+			if len(pkt) == 5 {
+				c.done(pkt[3:]) // EOF: warnings, status
+			} else {
+				_, n := lenenc(pkt[1:])
+				_, m := lenenc(pkt[1+n:])
+				c.done(pkt[1+n+m:]) // OK: affected rows, last insert id, status
+			}
+		case pkt[0] == 0xff: // ERR
+			c.state = IDLE
+		default:
+			c.rows++
+		}
+	}
+	if c.state == IDLE {
+		return p.send(c)
+	}
+	return true
+}
+
+// done ends the response unless the status flags say more results exist,
+// e.g. a CALL or multi-statement query.
+func (c *conn) done(status []byte) {
+	if len(status) >= 2 && binary.LittleEndian.Uint16(status)&SERVER_MORE_RESULTS_EXISTS != 0 {
+		c.state = FIRST
+		return
+	}
+	c.state = IDLE
+}
+
+// send sends the event of the connection's query, if any, ending at its last
+// response packet. It returns false if the parser is stopped.
+func (p *Parser) send(c *conn) bool {
+	if c.event == nil {
+		return true
+	}
+	e := c.event
+	c.event, c.state = nil, IDLE
+	e.OffsetEnd = p.offset
+	e.TimeMetrics["Query_time"] = c.end.Sub(c.start).Seconds()
+	e.NumberMetrics["Rows_sent"] = c.rows
+	select {
+	case p.events <- *e:
+		return true
+	case <-p.stop:
+		return false
+	}
+}
+
+// lenenc returns a length-encoded integer and its size in bytes, or zero
+// size if b is too short.
+func lenenc(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xfc:
+		if len(b) < 3 {
+			return 0, 0
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:])), 3
+	case 0xfd:
+		if len(b) < 4 {
+			return 0, 0
+		}
+		return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4
+	case 0xfe:
+		if len(b) < 9 {
+			return 0, 0
+		}
+		return binary.LittleEndian.Uint64(b[1:]), 9
+	}
+	return uint64(b[0]), 1
+}
+
+// nullString returns the null-terminated string at the start of b and the
+// rest of b after it.
+func nullString(b []byte) (string, []byte) {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i]), b[i+1:]
+		}
+	}
+	return string(b), nil
+}
@@ -0,0 +1,75 @@
+package pcap_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/pcap"
+	"github.com/go-mysql/slowlog"
+	"github.com/go-test/deep"
+)
+
+type event struct {
+	Ts           string
+	Query        string
+	User         string
+	Host         string
+	Db           string
+	QueryTime    float64
+	RowsSent     uint64
+	RowsAffected uint64
+}
+
+func TestParse(t *testing.T) {
+	fd, err := os.Open("../test/pcaps/mysql.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	p := pcap.NewParser(fd, pcap.DEFAULT_PORT)
+	if err := p.Start(slowlog.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	got := []event{}
+	for e := range p.Events() {
+		got = append(got, event{
+			Ts:           e.Ts,
+			Query:        e.Query,
+			User:         e.User,
+			Host:         e.Host,
+			Db:           e.Db,
+			QueryTime:    float64(int64(e.TimeMetrics["Query_time"]*1e6+0.5)) / 1e6, // µs
+			RowsSent:     e.NumberMetrics["Rows_sent"],
+			RowsAffected: e.NumberMetrics["Rows_affected"],
+		})
+	}
+	if err := p.Error(); err != nil {
+		t.Error(err)
+	}
+	expect := []event{
+		// Handshake, CLIENT_DEPRECATE_EOF, response in 3 segments
+		{"2017-01-01T00:00:01.000000Z", "SELECT id FROM orders WHERE id = 1", "app", "10.0.0.1", "shop", 0.0006, 1, 0},
+		// No handshake, EOF after columns and rows
+		{"2017-01-01T00:00:01.500000Z", "SELECT id FROM orders WHERE id = 2", "", "10.0.0.3", "", 0.003, 2, 0},
+		// Query retransmitted
+		{"2017-01-01T00:00:02.000000Z", "UPDATE orders SET status = 'shipped' WHERE id = 1", "app", "10.0.0.1", "shop", 0.002, 0, 1},
+		// More results
+		{"2017-01-01T00:00:03.000000Z", "CALL p()", "", "10.0.0.3", "", 0.02, 0, 0},
+		// Query attributes, ERR
+		{"2017-01-01T00:00:04.500000Z", "SELECT 3", "app", "10.0.0.1", "shop", 0.001, 0, 0},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestNotPcap(t *testing.T) {
+	fd, err := os.Open("../test/slowlogs/slow9001.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := pcap.NewParser(fd, pcap.DEFAULT_PORT).Start(slowlog.Options{}); err == nil {
+		t.Error("no error for slow log")
+	}
+}
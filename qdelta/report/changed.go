@@ -0,0 +1,35 @@
+package report
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+var changedColumns = []column{
+	{"sim", "sim", 4, " "},
+	{"base-id", "base ID", 16, " "},
+	{"comp-id", "comp ID", 16, " "},
+	{"fingerprint", "fingerprint", 0, " "},
+}
+
+// PrintChanged prints the missing and new queries that are the same query
+// changed (see delta.MatchChanged): the base (missing) fingerprint, then the
+// comp (new) fingerprint indented below it. In the delta tables, a changed
+// query has the comp ID. Layout.Limit and Layout.Columns are ignored.
+func PrintChanged(matches []delta.Match, base, comp slowlog.Result, layout Layout) {
+	layout.Limit = 0
+	t := newTable(os.Stdout, layout, changedColumns)
+	t.header()
+	for i, m := range matches {
+		t.row(fmt.Sprintf("%d", i+1), map[string]string{
+			"sim":         fmt.Sprintf("%.0f%%", m.Similarity*100),
+			"base-id":     m.BaseId,
+			"comp-id":     m.CompId,
+			"fingerprint": base.Class[m.BaseId].Fingerprint,
+		}, 0)
+		t.row("", map[string]string{"fingerprint": comp.Class[m.CompId].Fingerprint}, 0)
+	}
+}
@@ -0,0 +1,53 @@
+package report
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+)
+
+var contribColumns = []column{
+	{"contrib", "contrib", 7, " "},
+	{"delta", "delta", 7, "  "},
+	{"base", "base", 6, "  "},
+	{"comp", "comp", 6, "  "},
+	{"obsrv", "obsrv", 5, " "},
+	{"id", "ID", 16, " "},
+	{"fingerprint", "fingerprint", 0, " "},
+}
+
+// PrintContributions prints the global delta and each query's contribution
+// to it (see delta.Contributions) until a contribution is less than minPct
+// (percentage points) of the global delta, or layout.Limit queries. iter is
+// for the metric, like Print. Layout.Columns is ignored.
+func PrintContributions(global delta.Contribution, contribs []delta.Contribution, iter ResultIter, minPct float64, layout Layout) {
+	t := newTable(os.Stdout, layout, contribColumns)
+	t.header()
+	t.row("", map[string]string{
+		"contrib":     ftoa(global.Pct, true),
+		"delta":       ftoa(global.Delta, false),
+		"base":        ftoa(global.Base, false),
+		"comp":        ftoa(global.Comp, false),
+		"fingerprint": "(all queries)",
+	}, 0)
+	t.rows = 0 // global isn't a query
+	for _, c := range contribs {
+		if t.full() {
+			return
+		}
+		if math.Abs(c.Pct)*100 < minPct {
+			continue // small, but larger negative contributions are last
+		}
+		t.row(fmt.Sprintf("%d", t.rows+1), map[string]string{ // printed rows
+			"contrib":     ftoa(c.Pct, true),
+			"delta":       ftoa(c.Delta, false),
+			"base":        ftoa(c.Base, false),
+			"comp":        ftoa(c.Comp, false),
+			"obsrv":       iter.Observed(c.Id),
+			"id":          c.Id,
+			"fingerprint": iter.Fingerprint(c.Id),
+		}, sign(c.Delta))
+	}
+}
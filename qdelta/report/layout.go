@@ -0,0 +1,192 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// COLUMNS are the delta table columns in the default order.
+var COLUMNS = []string{"delta", "base", "comp", "obsrv", "conf", "id", "fingerprint"}
+
+// Layout is how a table is printed. The zero value is the default: every
+// row and column as fixed-width text.
+type Layout struct {
+	Limit    int      // print at most this many rows, or all if zero
+	Columns  []string // COLUMNS to print, in this order, or all if nil
+	Width    int      // truncate fingerprints to this many characters, or not if zero
+	Color    bool     // color delta increases red and decreases green (ANSI)
+	Markdown bool     // print a Markdown table instead of text
+}
+
+// ParseColumns returns the columns in a comma-separated list like
+// "delta,id,fingerprint", or an error if one isn't in COLUMNS.
+func ParseColumns(list string) ([]string, error) {
+	columns := []string{}
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		valid := false
+		for _, name := range COLUMNS {
+			if c == name {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid column: %s: expected one of %s", c, strings.Join(COLUMNS, ", "))
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// column is one column of a text table: its header, width, and separator
+// from the previous column. The fingerprint column is last and has no width.
+type column struct {
+	name   string
+	header string
+	width  int
+	sep    string
+}
+
+var deltaColumns = map[string]column{
+	"delta":       {"delta", "delta", 7, " "},
+	"base":        {"base", "base", 6, "  "},
+	"comp":        {"comp", "comp", 6, "  "},
+	"obsrv":       {"obsrv", "obsrv", 5, " "},
+	"conf":        {"conf", "conf", 4, " "},
+	"id":          {"id", "ID", 16, " "},
+	"fingerprint": {"fingerprint", "fingerprint", 0, " "},
+}
+
+const (
+	ANSI_RED   = "\x1b[31m"
+	ANSI_GREEN = "\x1b[32m"
+	ANSI_RESET = "\x1b[0m"
+)
+
+// table prints the header and rows of a table in a layout.
+type table struct {
+	w       io.Writer
+	layout  Layout
+	columns []column
+	rows    int
+}
+
+func newTable(w io.Writer, layout Layout, columns []column) *table {
+	return &table{w: w, layout: layout, columns: columns}
+}
+
+func (t *table) header() {
+	if t.layout.Markdown {
+		headers := []string{"#"}
+		align := []string{"--:"}
+		for _, c := range t.columns {
+			headers = append(headers, c.header)
+			if c.width == 0 {
+				align = append(align, ":--") // fingerprint
+			} else {
+				align = append(align, "--:")
+			}
+		}
+		fmt.Fprintf(t.w, "| %s |\n", strings.Join(headers, " | "))
+		fmt.Fprintf(t.w, "|%s|\n", strings.Join(align, "|"))
+		return
+	}
+	dashes := map[string]string{}
+	headers := map[string]string{}
+	for _, c := range t.columns {
+		n := c.width
+		if n == 0 {
+			n = len(c.header)
+		}
+		dashes[c.name] = strings.Repeat("-", n)
+		headers[c.name] = c.header
+	}
+	t.line("#", dashes, 0)
+	t.line("#", headers, 0)
+	t.line("#", dashes, 0)
+}
+
+// full returns true if Limit rows have been printed.
+func (t *table) full() bool {
+	return t.layout.Limit > 0 && t.rows >= t.layout.Limit
+}
+
+// row prints a row: its number (or "") and column values. sign is the sign
+// of the delta, which is colored if Color.
+func (t *table) row(n string, values map[string]string, sign int) {
+	t.rows++
+	if fp, ok := values["fingerprint"]; ok {
+		values["fingerprint"] = truncate(fp, t.layout.Width)
+	}
+	if t.layout.Markdown {
+		cells := []string{n}
+		for _, c := range t.columns {
+			v := values[c.name]
+			if c.name == "fingerprint" && v != "" {
+				v = code(v)
+			}
+			cells = append(cells, strings.Replace(v, "|", "\\|", -1))
+		}
+		fmt.Fprintf(t.w, "| %s |\n", strings.Join(cells, " | "))
+		return
+	}
+	t.line(n, values, sign)
+}
+
+func (t *table) line(n string, values map[string]string, sign int) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-3s", n)
+	for _, c := range t.columns {
+		b.WriteString(c.sep)
+		if c.width == 0 {
+			b.WriteString(values[c.name])
+			continue
+		}
+		v := fmt.Sprintf("%*s", c.width, values[c.name])
+		if c.name == "delta" && t.layout.Color && sign != 0 {
+			color := ANSI_RED
+			if sign < 0 {
+				color = ANSI_GREEN
+			}
+			v = color + v + ANSI_RESET
+		}
+		b.WriteString(v)
+	}
+	fmt.Fprintln(t.w, strings.TrimRight(b.String(), " "))
+}
+
+// code returns s as Markdown inline code so that * and _ in a fingerprint
+// aren't emphasis.
+func code(s string) string {
+	if strings.Contains(s, "`") {
+		return "`` " + s + " ``" // e.g. digest fingerprint SELECT `c` FROM `t`
+	}
+	return "`" + s + "`"
+}
+
+// sign returns the sign of a delta: -1, 0, or 1. It's the value, not the
+// formatted delta, which can be rounded like "0.00" or "-0.00".
+func sign(delta float64) int {
+	switch {
+	case delta > 0:
+		return 1
+	case delta < 0:
+		return -1
+	}
+	return 0
+}
+
+// truncate returns the fingerprint truncated to width characters ending in
+// "...", or the whole fingerprint if width is zero or it fits.
+func truncate(fingerprint string, width int) string {
+	r := []rune(fingerprint)
+	if width <= 0 || len(r) <= width {
+		return fingerprint
+	}
+	if width <= 3 {
+		return string(r[:width])
+	}
+	return string(r[:width-3]) + "..."
+}
@@ -0,0 +1,110 @@
+package report_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/report"
+	"github.com/go-test/deep"
+)
+
+func TestLayout001(t *testing.T) {
+	base, err := loadSlowlogResults("001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("001-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := delta.Merge(base, comp)
+	deltas := delta.Delta(metrics, "qps")
+	iter := report.NewRealIter("qps", base, comp, metrics)
+
+	print := func(layout report.Layout) []string {
+		var buf bytes.Buffer
+		report.Fprint(&buf, deltas, iter, 0, 0, layout)
+		return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	// Default is the original fixed-width text
+	expect := []string{
+		"#   -------  ------  ------ ----- ---- ---------------- -----------",
+		"#     delta    base    comp obsrv conf               ID fingerprint",
+		"#   -------  ------  ------ ----- ---- ---------------- -----------",
+		"1       100       0     100   new 100%                D query d",
+		"2       100       0     100   new 100%                E query e",
+		"3         0      55      55  base   0%                A query a",
+		"4         0      38      38  base   0%                B query b",
+		"5         0       5       5  base   0%                C query c",
+	}
+	if diff := deep.Equal(print(report.Layout{}), expect); diff != nil {
+		t.Error(diff)
+	}
+
+	expect = []string{
+		"#   ------- ---------------- -----------",
+		"#     delta               ID fingerprint",
+		"#   ------- ---------------- -----------",
+		"1       100                D qu...",
+		"2       100                E qu...",
+	}
+	got := print(report.Layout{Limit: 2, Columns: []string{"delta", "id", "fingerprint"}, Width: 5})
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	expect = []string{
+		"| # | delta | ID | fingerprint |",
+		"|--:|--:|--:|:--|",
+		"| 1 | 100 | D | `query d` |",
+	}
+	got = print(report.Layout{Limit: 1, Columns: []string{"delta", "id", "fingerprint"}, Markdown: true})
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Increase is red, no change isn't colored
+	got = print(report.Layout{Color: true})
+	if got[3] != "1   \x1b[31m    100\x1b[0m       0     100   new 100%                D query d" {
+		t.Errorf("got colored increase %q", got[3])
+	}
+	if got[5] != "3         0      55      55  base   0%                A query a" {
+		t.Errorf("got colored no change %q", got[5])
+	}
+
+	// Rows are numbered as printed, so hidden rows don't skip numbers
+	d := metrics["D"]
+	d.Confidence.QPS = 0
+	metrics["D"] = d
+	var buf bytes.Buffer
+	report.Fprint(&buf, deltas, iter, 0, 0.5, report.Layout{Columns: []string{"delta", "id"}})
+	expect = []string{
+		"#   ------- ----------------",
+		"#     delta               ID",
+		"#   ------- ----------------",
+		"1       100                E",
+	}
+	if diff := deep.Equal(strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"), expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Small deltas are colored by their value, not how they're rounded
+	small := []delta.Metrics{{Id: "A", QPS: 0.001}, {Id: "B", QPS: -0.001}}
+	buf.Reset()
+	report.Fprint(&buf, small, iter, 0, 0, report.Layout{Columns: []string{"delta", "id"}, Color: true})
+	got = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[3:]
+	expect = []string{
+		"1   \x1b[31m   0.00\x1b[0m                A",
+		"2   \x1b[32m  -0.00\x1b[0m                B",
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	if _, err := report.ParseColumns("delta,nope"); err == nil {
+		t.Error("no error for invalid column")
+	}
+}
@@ -0,0 +1,132 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+)
+
+// Value is one metric of one query: the delta, its base and comp values, and
+// confidence (0-1) that the delta is real. Percentages are 0-100, like the
+// text report. Base and comp of a metric of another metric (delta.Metric.Of),
+// like avg-rel, are the other metric's values, like the text report.
+type Value struct {
+	Delta      float64 `json:"delta"`
+	Base       float64 `json:"base"`
+	Comp       float64 `json:"comp"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Row is every metric of one query, for machine-readable output.
+type Row struct {
+	Id          string           `json:"id"`
+	Fingerprint string           `json:"fingerprint"`
+	Observed    string           `json:"observed"`          // base, new, miss, or changed
+	BaseId      string           `json:"base_id,omitempty"` // if changed, the missing query ID
+	Metrics     map[string]Value `json:"metrics"`           // metric name => value
+}
+
+// Rows returns a Row for every delta in the same order with the metrics,
+// which must be registered (see delta.Lookup). Nil is every metric.
+func Rows(deltas []delta.Metrics, iter *RealIter, metrics []string) []Row {
+	mts := lookup(metrics)
+	rows := make([]Row, len(deltas))
+	for i, d := range deltas {
+		m := iter.metrics[d.Id]
+		rows[i] = Row{
+			Id:          d.Id,
+			Fingerprint: iter.Fingerprint(d.Id),
+			Observed:    iter.Observed(d.Id),
+			BaseId:      m.BaseId,
+			Metrics:     make(map[string]Value, len(mts)),
+		}
+		for _, mt := range mts {
+			baseComp := mt
+			if mt.Of != "" {
+				baseComp, _ = delta.Lookup(mt.Of)
+			}
+			rows[i].Metrics[mt.Name] = Value{
+				Delta:      mt.Value(d) * scale(mt),
+				Base:       mt.Compared(m.Base) * scale(baseComp),
+				Comp:       mt.Compared(m.Comp) * scale(baseComp),
+				Confidence: mt.Value(m.Confidence),
+			}
+		}
+	}
+	return rows
+}
+
+// lookup returns the registered metrics by name, or every metric if nil.
+func lookup(names []string) []delta.Metric {
+	if names == nil {
+		return delta.Registered()
+	}
+	metrics := make([]delta.Metric, len(names))
+	for i, name := range names {
+		mt, ok := delta.Lookup(name)
+		if !ok {
+			panic(fmt.Sprintf("invalid metric: %s", name))
+		}
+		metrics[i] = mt
+	}
+	return metrics
+}
+
+// scale returns what values of the metric are multiplied by for output:
+// 100 for percentages, else 1.
+func scale(mt delta.Metric) float64 {
+	if mt.Unit == delta.PERCENT {
+		return 100
+	}
+	return 1
+}
+
+// PrintJSON writes the rows as a JSON array.
+func PrintJSON(w io.Writer, rows []Row) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+// PrintCSV writes the rows as CSV with a header line. The columns are id,
+// observed, base_id, the delta, base, comp, and confidence of each metric
+// (nil is every metric, like Rows), and fingerprint. Metric column names
+// are the metric name with underscores, e.g. rows_examined_delta.
+func PrintCSV(w io.Writer, rows []Row, metrics []string) error {
+	cw := csv.NewWriter(w)
+	mts := lookup(metrics)
+	header := []string{"id", "observed", "base_id"}
+	for _, mt := range mts {
+		name := strings.Replace(mt.Name, "-", "_", -1)
+		header = append(header, name+"_delta", name+"_base", name+"_comp", name+"_conf")
+	}
+	header = append(header, "fingerprint")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		rec := []string{r.Id, r.Observed, r.BaseId}
+		for _, mt := range mts {
+			rec = append(rec, r.Metrics[mt.Name].csv()...)
+		}
+		rec = append(rec, r.Fingerprint)
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (v Value) csv() []string {
+	return []string{ftoaRaw(v.Delta), ftoaRaw(v.Base), ftoaRaw(v.Comp), ftoaRaw(v.Confidence)}
+}
+
+func ftoaRaw(val float64) string {
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
@@ -0,0 +1,90 @@
+package report_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/report"
+	"github.com/go-test/deep"
+)
+
+func TestCSV001(t *testing.T) {
+	base, err := loadSlowlogResults("001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("001-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := delta.Merge(base, comp)
+	deltas := delta.Delta(metrics, "qps")
+	rows := report.Rows(deltas, report.NewRealIter("qps", base, comp, metrics), nil)
+
+	var buf bytes.Buffer
+	if err := report.PrintCSV(&buf, rows, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(got) != 6 {
+		t.Fatalf("got %d lines, expected 6: %s", len(got), got)
+	}
+	expect := []string{
+		"id,observed,base_id,qps_delta,qps_base,qps_comp,qps_conf,load_delta,load_base,load_comp,load_conf,count_delta,count_base,count_comp,count_conf,exectime_delta,exectime_base,exectime_comp,exectime_conf,avg_delta,avg_base,avg_comp,avg_conf,p95_delta,p95_base,p95_comp,p95_conf,avg_rel_delta,avg_rel_base,avg_rel_comp,avg_rel_conf,p95_rel_delta,p95_rel_base,p95_rel_comp,p95_rel_conf,lock_delta,lock_base,lock_comp,lock_conf,rows_examined_delta,rows_examined_base,rows_examined_comp,rows_examined_conf,rows_sent_delta,rows_sent_base,rows_sent_comp,rows_sent_conf,io_r_ops_delta,io_r_ops_base,io_r_ops_comp,io_r_ops_conf,rec_lock_wait_delta,rec_lock_wait_base,rec_lock_wait_comp,rec_lock_wait_conf,queue_wait_delta,queue_wait_base,queue_wait_comp,queue_wait_conf,tmp_tables_delta,tmp_tables_base,tmp_tables_comp,tmp_tables_conf,full_scan_delta,full_scan_base,full_scan_comp,full_scan_conf,filesort_delta,filesort_base,filesort_comp,filesort_conf,bytes_sent_delta,bytes_sent_base,bytes_sent_comp,bytes_sent_conf,fingerprint",
+		"D,new,,100,0,100,1,1.9444444444444444,0,1.9444444444444444,1,33.33333333333333,0,33.33333333333333,1,24.647887323943664,0,24.647887323943664,1,0.01,0,0.01,0,0.05,0,0.05,0,0,0,0.01,0,0,0,0.05,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,query d",
+	}
+	if diff := deep.Equal(got[0:2], expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestJSONMetrics001(t *testing.T) {
+	base, err := loadSlowlogResults("001-base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := loadSlowlogResults("001-comp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only -metrics, and avg-rel base and comp are avg, in seconds
+	metrics := delta.Merge(base, comp)
+	deltas := delta.Delta(metrics, "qps")
+	rows := report.Rows(deltas, report.NewRealIter("qps", base, comp, metrics), []string{"count", "avg-rel"})
+	if len(rows) != 5 {
+		t.Fatalf("got %d rows, expected 5", len(rows))
+	}
+	expect := report.Row{
+		Id:          "D",
+		Fingerprint: "query d",
+		Observed:    "new",
+		Metrics: map[string]report.Value{
+			"count":   {33.33333333333333, 0, 33.33333333333333, 1},
+			"avg-rel": {0, 0, 0.01, 0},
+		},
+	}
+	if diff := deep.Equal(rows[0], expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := report.PrintCSV(&buf, rows[:1], []string{"count", "avg-rel"}); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expectCSV := []string{
+		"id,observed,base_id,count_delta,count_base,count_comp,count_conf,avg_rel_delta,avg_rel_base,avg_rel_comp,avg_rel_conf,fingerprint",
+		"D,new,,33.33333333333333,0,33.33333333333333,1,0,0,0.01,0,query d",
+	}
+	if diff := deep.Equal(got, expectCSV); diff != nil {
+		t.Error(diff)
+	}
+}
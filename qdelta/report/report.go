@@ -2,57 +2,82 @@ package report
 
 import (
 	"fmt"
+	"io"
 	"math"
+	"os"
 	"strconv"
 
 	"github.com/daniel-nichter/lab/qdelta/delta"
 	"github.com/daniel-nichter/lab/qdelta/slowlog"
 )
 
-const (
-	HEADER_LINE_FMT = "#   %7s  %6s  %6s %5s %16s %s\n"
-	DELTA_LINE_FMT  = "%-3d %7s  %6s  %6s %5s %16s %s\n"
-)
+// Print prints deltas until one is less than minDelta, or layout.Limit
+// deltas. Deltas with less than minConfidence (0 to 1) are not printed
+// because they're probably noise.
+func Print(deltas []delta.Metrics, iter ResultIter, minDelta, minConfidence float64, layout Layout) {
+	Fprint(os.Stdout, deltas, iter, minDelta, minConfidence, layout)
+}
 
-func Print(deltas []delta.Metrics, iter ResultIter, minDelta float64) {
-	fmt.Printf(HEADER_LINE_FMT, "-------", "------", "------", "-----", "----------------", "-----------")
-	fmt.Printf(HEADER_LINE_FMT, "delta", "base", "comp", "obsrv", "ID", "fingerprint")
-	fmt.Printf(HEADER_LINE_FMT, "-------", "------", "------", "-----", "----------------", "-----------")
-	for i, d := range deltas {
-		if iter.AbsDelta(d) < minDelta {
+// Fprint is Print to w.
+func Fprint(w io.Writer, deltas []delta.Metrics, iter ResultIter, minDelta, minConfidence float64, layout Layout) {
+	names := layout.Columns
+	if len(names) == 0 {
+		names = COLUMNS
+	}
+	columns := make([]column, len(names))
+	for i, name := range names {
+		columns[i] = deltaColumns[name]
+	}
+	t := newTable(w, layout, columns)
+	t.header()
+	for _, d := range deltas {
+		if iter.AbsDelta(d) < minDelta || t.full() {
 			return // don't print small deltas
 		}
-		fmt.Printf(DELTA_LINE_FMT,
-			i+1,
-			iter.Delta(d),
-			iter.Base(d.Id),
-			iter.Comp(d.Id),
-			iter.Observed(d.Id),
-			d.Id,
-			iter.Fingerprint(d.Id),
-		)
+		conf := iter.Confidence(d.Id)
+		if conf < minConfidence {
+			continue // don't print noise
+		}
+		// Number printed rows, not deltas, which skip hidden rows
+		t.row(strconv.Itoa(t.rows+1), map[string]string{
+			"delta":       iter.Delta(d),
+			"base":        iter.Base(d.Id),
+			"comp":        iter.Comp(d.Id),
+			"obsrv":       iter.Observed(d.Id),
+			"conf":        fmt.Sprintf("%.0f%%", conf*100),
+			"id":          d.Id,
+			"fingerprint": iter.Fingerprint(d.Id),
+		}, sign(iter.RawDelta(d)))
 	}
 }
 
 type ResultIter interface {
 	AbsDelta(delta.Metrics) float64
+	RawDelta(delta.Metrics) float64
 	Delta(delta.Metrics) string
 	Base(id string) string
 	Comp(id string) string
 	Observed(id string) string
+	Confidence(id string) float64
 	Fingerprint(id string) string
 }
 
 type RealIter struct {
-	metric  string
+	mt      delta.Metric
 	base    slowlog.Result
 	comp    slowlog.Result
 	metrics map[string]delta.Result
 }
 
+// NewRealIter returns an iter for the metric, which must be registered (see
+// delta.Lookup).
 func NewRealIter(metric string, base, comp slowlog.Result, metrics map[string]delta.Result) *RealIter {
+	mt, ok := delta.Lookup(metric)
+	if !ok {
+		panic(fmt.Sprintf("invalid metric: %s", metric))
+	}
 	return &RealIter{
-		metric:  metric,
+		mt:      mt,
 		base:    base,
 		comp:    comp,
 		metrics: metrics,
@@ -60,31 +85,15 @@ func NewRealIter(metric string, base, comp slowlog.Result, metrics map[string]de
 }
 
 func (i *RealIter) AbsDelta(d delta.Metrics) float64 {
-	switch i.metric {
-	case "qps":
-		return math.Abs(d.QPS)
-	case "load":
-		return math.Abs(d.Load)
-	case "count":
-		return math.Abs(d.CountPct) * 100
-	case "exectime":
-		return math.Abs(d.ExecTimePct) * 100
-	}
-	return 0
+	return absValue(i.mt, i.mt.Value(d))
+}
+
+func (i *RealIter) RawDelta(d delta.Metrics) float64 {
+	return i.mt.Value(d)
 }
 
 func (i *RealIter) Delta(d delta.Metrics) string {
-	switch i.metric {
-	case "qps":
-		return ftoa(d.QPS, false)
-	case "load":
-		return ftoa(d.Load, false)
-	case "count":
-		return ftoa(d.CountPct, true)
-	case "exectime":
-		return ftoa(d.ExecTimePct, true)
-	}
-	return ""
+	return format(i.mt.Unit, i.mt.Value(d))
 }
 
 func (i *RealIter) Base(id string) string {
@@ -103,23 +112,22 @@ func (i *RealIter) Comp(id string) string {
 	return i.baseComp(m.Comp)
 }
 
+// baseComp formats a base or comp value, which for a metric like avg-rel is
+// its Of metric's value.
 func (i *RealIter) baseComp(m delta.Metrics) string {
-	switch i.metric {
-	case "qps":
-		return ftoa(m.QPS, false)
-	case "load":
-		return ftoa(m.Load, false)
-	case "count":
-		return ftoa(m.CountPct, true)
-	case "exectime":
-		return ftoa(m.ExecTimePct, true)
+	unit := i.mt.Unit
+	if i.mt.Of != "" {
+		of, _ := delta.Lookup(i.mt.Of)
+		unit = of.Unit
 	}
-	return "?"
+	return format(unit, i.mt.Compared(m))
 }
 
 func (i *RealIter) Observed(id string) string {
 	m := i.metrics[id]
 	switch {
+	case m.BaseId != "": // see delta.MatchChanged
+		return "changed"
 	case m.InBase && m.InComp:
 		return "base"
 	case m.InComp: // but not in base
@@ -130,6 +138,10 @@ func (i *RealIter) Observed(id string) string {
 	return "?" // not in either?
 }
 
+func (i *RealIter) Confidence(id string) float64 {
+	return i.mt.Value(i.metrics[id].Confidence)
+}
+
 func (i *RealIter) Fingerprint(id string) string {
 	if _, ok := i.base.Class[id]; ok {
 		return i.base.Class[id].Fingerprint
@@ -137,6 +149,30 @@ func (i *RealIter) Fingerprint(id string) string {
 	return i.comp.Class[id].Fingerprint
 }
 
+// format formats a value of the unit: percentages 0-100, seconds like dtoa,
+// and numbers like ftoa.
+func format(unit delta.Unit, val float64) string {
+	switch unit {
+	case delta.PERCENT:
+		return ftoa(val, true)
+	case delta.SECONDS:
+		return dtoa(val)
+	}
+	return ftoa(val, false)
+}
+
+// absValue returns the absolute value of the metric in the units of
+// -min-delta: percentage points, milliseconds, or the number.
+func absValue(mt delta.Metric, val float64) float64 {
+	switch mt.Unit {
+	case delta.PERCENT:
+		return math.Abs(val) * 100
+	case delta.SECONDS:
+		return math.Abs(val) * 1000 // ms
+	}
+	return math.Abs(val)
+}
+
 func ftoa(val float64, pct bool) string {
 	if val == 0 {
 		return "0"
@@ -149,3 +185,17 @@ func ftoa(val float64, pct bool) string {
 	}
 	return strconv.Itoa(int(val)) // > 1  and not %
 }
+
+// dtoa formats seconds like 1.50s, 12.3ms, or 250us.
+func dtoa(val float64) string {
+	abs := math.Abs(val)
+	switch {
+	case val == 0:
+		return "0"
+	case abs >= 1:
+		return fmt.Sprintf("%.2fs", val)
+	case abs >= 0.001:
+		return fmt.Sprintf("%.1fms", val*1000)
+	}
+	return fmt.Sprintf("%.0fus", val*1000000)
+}
@@ -111,4 +111,31 @@ func Test001(t *testing.T) {
 			}
 		}
 	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Avg Query_time
+
+	deltas = delta.Delta(metrics, "avg")
+	iter = report.NewRealIter("avg", base, comp, metrics)
+
+	// [delta,base,comp,obsrv]
+	expect = [][]string{
+		{"10.0ms", "0", "10.0ms", "new"},  // D
+		{"10.0ms", "0", "10.0ms", "new"},  // E
+		{"0", "10.0ms", "10.0ms", "base"}, // A
+		{"0", "10.0ms", "10.0ms", "base"}, // B
+		{"0", "10.0ms", "10.0ms", "base"}, // C
+	}
+	for i, d := range deltas {
+		got := []string{"", "", "", ""}
+		got[0] = iter.Delta(d)
+		got[1] = iter.Base(d.Id)
+		got[2] = iter.Comp(d.Id)
+		got[3] = iter.Observed(d.Id)
+		if diff := deep.Equal(got, expect[i]); diff != nil {
+			for _, d := range diff {
+				t.Errorf("avg %d: %s", i, d)
+			}
+		}
+	}
 }
@@ -0,0 +1,58 @@
+package report
+
+import (
+	"fmt"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+const (
+	SERIES_HEADER_LINE_FMT = "#   %7s %19s  %7s  %6s  %6s %16s %s\n"
+	SERIES_LINE_FMT        = "%-3d %7s %19s  %7s  %6s  %6s %16s %s\n"
+)
+
+// PrintSeries prints the changes of one metric across the buckets. orderBy
+// is how the changes are ordered (jump or slope) and which is compared to
+// minDelta. The jump time is the start of the bucket in which the jump ended.
+func PrintSeries(changes []delta.Change, metric, orderBy string, buckets []slowlog.Interval, res []slowlog.Result, minDelta float64) {
+	mt, ok := delta.Lookup(metric)
+	if !ok {
+		panic(fmt.Sprintf("invalid metric: %s", metric))
+	}
+	fmt.Printf(SERIES_HEADER_LINE_FMT, "-------", "-------------------", "-------", "------", "------", "----------------", "-----------")
+	fmt.Printf(SERIES_HEADER_LINE_FMT, "jump", "at", "slope", "min", "max", "ID", "fingerprint")
+	fmt.Printf(SERIES_HEADER_LINE_FMT, "-------", "-------------------", "-------", "------", "------", "----------------", "-----------")
+	for i, c := range changes {
+		v := c.Jump
+		if orderBy == "slope" {
+			v = c.Slope
+		}
+		if absValue(mt, v) < minDelta {
+			return // don't print small changes
+		}
+		at := ""
+		if c.At > 0 {
+			at = buckets[c.At].Since.Format("2006-01-02T15:04:05")
+		}
+		fmt.Printf(SERIES_LINE_FMT,
+			i+1,
+			format(mt.Unit, c.Jump),
+			at,
+			format(mt.Unit, c.Slope),
+			format(mt.Unit, c.Min),
+			format(mt.Unit, c.Max),
+			c.Id,
+			seriesFingerprint(c.Id, res),
+		)
+	}
+}
+
+func seriesFingerprint(id string, res []slowlog.Result) string {
+	for _, r := range res {
+		if class, ok := r.Class[id]; ok {
+			return class.Fingerprint
+		}
+	}
+	return ""
+}
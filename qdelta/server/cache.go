@@ -0,0 +1,65 @@
+package server
+
+import (
+	"container/list"
+
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// CACHE_SIZE is the default number of slow log results (one per name/range)
+// that a Server caches. Clients can request any range, so the least recently
+// used results are evicted.
+const CACHE_SIZE = 100
+
+// cache is an LRU cache of results keyed on source.key. It's not safe for
+// concurrent use; Server.mu guards it.
+type cache struct {
+	size  int
+	order *list.List               // of *entry, most recently used first
+	items map[string]*list.Element // key => element in order
+}
+
+type entry struct {
+	key string
+	res slowlog.Result
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *cache) get(key string) (slowlog.Result, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return slowlog.Result{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*entry).res, true
+}
+
+func (c *cache) add(key string, res slowlog.Result) {
+	if e, ok := c.items[key]; ok {
+		e.Value.(*entry).res = res
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&entry{key, res})
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*entry).key)
+	}
+}
+
+// keys returns the cached keys, most recently used first.
+func (c *cache) keys() []string {
+	keys := make([]string, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*entry).key)
+	}
+	return keys
+}
@@ -0,0 +1,13 @@
+package server
+
+// SetCacheSize replaces the cache of s with an empty one of the size.
+func SetCacheSize(s *Server, size int) {
+	s.cache = newCache(size)
+}
+
+// Cached returns the cached name/range keys of s, most recently used first.
+func Cached(s *Server) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.keys()
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"html/template"
+)
+
+type indexPage struct {
+	Sources      []string
+	Comparison   *comparison
+	MinDelta     float64
+	Significance float64
+	Tables       []table
+}
+
+type table struct {
+	Metric string
+	Rows   []row
+}
+
+type row struct {
+	N           int
+	Metric      string
+	Delta       string
+	Base        string
+	Comp        string
+	Observed    string
+	Confidence  string
+	Id          string
+	Fingerprint string
+	Link        string
+}
+
+type queryPage struct {
+	Comparison  *comparison
+	Back        string
+	Id          string
+	Fingerprint string
+	Observed    string
+	Example     string
+	Metrics     []row
+}
+
+const style = `<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 2px 8px; text-align: right; }
+td.fp, th.fp { text-align: left; font-family: monospace; }
+tr:nth-child(even) { background: #f4f4f4; }
+pre { background: #f4f4f4; padding: 1em; white-space: pre-wrap; }
+</style>`
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>qdelta</title>` + style + `</head>
+<body>
+<form method="get" action="/">
+<p>
+base <select name="base-file">{{range .Sources}}<option{{if eq . $.Comparison.BaseFile}} selected{{end}}>{{.}}</option>{{end}}</select>
+<input name="base" size="42" placeholder="2017-01-01T00:00:00/2017-01-01T01:00:00" value="{{.Comparison.Base}}">
+</p>
+<p>
+comp <select name="comp-file">{{range .Sources}}<option{{if eq . $.Comparison.CompFile}} selected{{end}}>{{.}}</option>{{end}}</select>
+<input name="comp" size="42" placeholder="2017-01-01T01:00:00/2017-01-01T02:00:00" value="{{.Comparison.Comp}}">
+</p>
+<p>
+min delta <input name="min-delta" size="4" value="{{.MinDelta}}">
+significance <input name="significance" size="4" value="{{.Significance}}" title="Minimum confidence (0-1). Per-query metric confidence is a rough normal approximation, too high for skewed values like Query_time.">
+<input type="submit" value="Compare">
+</p>
+</form>
+{{range .Tables}}
+<h2>{{.Metric}} delta</h2>
+<table>
+<tr><th>#</th><th>delta</th><th>base</th><th>comp</th><th>obsrv</th><th>conf</th><th class="fp">ID</th><th class="fp">fingerprint</th></tr>
+{{range .Rows}}<tr><td>{{.N}}</td><td>{{.Delta}}</td><td>{{.Base}}</td><td>{{.Comp}}</td><td>{{.Observed}}</td><td>{{.Confidence}}</td><td class="fp">{{.Id}}</td><td class="fp"><a href="{{.Link}}">{{.Fingerprint}}</a></td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+var queryTemplate = template.Must(template.New("query").Parse(`<!DOCTYPE html>
+<html>
+<head><title>qdelta: {{.Id}}</title>` + style + `</head>
+<body>
+<p><a href="{{.Back}}">&larr; all queries</a></p>
+<h2>{{.Id}} ({{.Observed}})</h2>
+<p>base {{.Comparison.BaseFile}} {{.Comparison.Base}}<br>comp {{.Comparison.CompFile}} {{.Comparison.Comp}}</p>
+<pre>{{.Fingerprint}}</pre>
+<table>
+<tr><th class="fp">metric</th><th>delta</th><th>base</th><th>comp</th><th>conf</th></tr>
+{{range .Metrics}}<tr><td class="fp">{{.Metric}}</td><td>{{.Delta}}</td><td>{{.Base}}</td><td>{{.Comp}}</td><td>{{.Confidence}}</td></tr>
+{{end}}</table>
+{{if .Example}}<h3>Example</h3>
+<pre>{{.Example}}</pre>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,415 @@
+// Package server serves deltas over HTTP: a JSON API and a simple web UI.
+// Every comparison is a URL, so it can be shared and reproduced exactly.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/daniel-nichter/lab/qdelta/delta"
+	"github.com/daniel-nichter/lab/qdelta/report"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+)
+
+// Server compares results from a fixed set of local slow logs and saved
+// results. Clients name a source by its base name, e.g. slow.log, never by
+// path, so only the given files are served.
+type Server struct {
+	p       *slowlog.Processor
+	files   map[string]string         // slow logs: name => path
+	results map[string]slowlog.Result // saved results: name => result
+	names   []string                  // all sources, in order given
+
+	mu       sync.Mutex         // guards cache and inflight, not processing
+	cache    *cache             // name/range => result
+	inflight map[string]*result // name/range => result being processed
+}
+
+// result is a slow log result being processed for one name/range. done is
+// closed when res and err are set, so concurrent requests for the same
+// name/range wait for one processing run.
+type result struct {
+	done chan struct{}
+	res  slowlog.Result
+	err  error
+}
+
+// New returns a Server for the slow logs and saved results (see slowlog.Save).
+// Slow logs are processed by p on demand, once per time range, and the last
+// CACHE_SIZE results are cached. Saved results are loaded now.
+func New(p *slowlog.Processor, files, results []string) (*Server, error) {
+	s := &Server{
+		p:        p,
+		files:    map[string]string{},
+		results:  map[string]slowlog.Result{},
+		names:    []string{},
+		cache:    newCache(CACHE_SIZE),
+		inflight: map[string]*result{},
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if err := s.add(name); err != nil {
+			return nil, err
+		}
+		s.files[name] = file
+	}
+	for _, file := range results {
+		name := filepath.Base(file)
+		if err := s.add(name); err != nil {
+			return nil, err
+		}
+		res, err := slowlog.Load(file)
+		if err != nil {
+			return nil, err
+		}
+		s.results[name] = res
+	}
+	if len(s.names) == 0 {
+		return nil, fmt.Errorf("no slow logs or saved results")
+	}
+	return s, nil
+}
+
+func (s *Server) add(name string) error {
+	for _, n := range s.names {
+		if n == name {
+			return fmt.Errorf("duplicate file name: %s", name)
+		}
+	}
+	s.names = append(s.names, name)
+	return nil
+}
+
+// Handler returns the HTTP handler:
+//
+//	/            web UI: delta tables for a comparison
+//	/query       web UI: every metric of one query (id param)
+//	/api/delta   JSON report.Row for every query, ordered by order-by
+//	/api/sources JSON list of source names
+//
+// A comparison is the query params base-file, base, comp-file, and comp, like
+// the command line options, except files are source names. base-file and
+// comp-file default to the first source.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.index)
+	mux.HandleFunc("/query", s.query)
+	mux.HandleFunc("/api/delta", s.apiDelta)
+	mux.HandleFunc("/api/sources", s.apiSources)
+	return mux
+}
+
+// comparison is one base vs. comp comparison from request params.
+type comparison struct {
+	BaseFile string
+	Base     string
+	CompFile string
+	Comp     string
+
+	base    slowlog.Result
+	comp    slowlog.Result
+	metrics map[string]delta.Result
+}
+
+// compare returns the comparison for the request params, processing slow
+// logs as needed.
+func (s *Server) compare(q url.Values) (*comparison, error) {
+	c := &comparison{
+		BaseFile: q.Get("base-file"),
+		Base:     q.Get("base"),
+		CompFile: q.Get("comp-file"),
+		Comp:     q.Get("comp"),
+	}
+	if c.BaseFile == "" {
+		c.BaseFile = s.names[0]
+	}
+	if c.CompFile == "" {
+		c.CompFile = s.names[0]
+	}
+	res, err := s.get(source{c.BaseFile, c.Base}, source{c.CompFile, c.Comp})
+	if err != nil {
+		return nil, err
+	}
+	c.base = res[0]
+	c.comp = res[1]
+	c.metrics = delta.Merge(c.base, c.comp)
+	delta.MatchChanged(c.metrics, c.base, c.comp, delta.DEFAULT_SIMILARITY)
+	return c, nil
+}
+
+// Values returns the comparison as query params.
+func (c *comparison) Values() url.Values {
+	q := url.Values{}
+	for k, v := range map[string]string{"base-file": c.BaseFile, "base": c.Base, "comp-file": c.CompFile, "comp": c.Comp} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	return q
+}
+
+// source is a source name and time range.
+type source struct {
+	name      string
+	timeRange string
+}
+
+// get returns the result of each source. Uncached time ranges of the same
+// slow log are processed together in one pass. Requests for a time range
+// that's already being processed wait for it instead of processing it again.
+func (s *Server) get(sources ...source) ([]slowlog.Result, error) {
+	// Check every source before any is put in inflight, else an invalid
+	// source would leave the others there, never processed
+	for _, src := range sources {
+		if err := s.check(src); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]slowlog.Result, len(sources))
+	wait := map[int]*result{}     // sources[n] => result being processed
+	todo := map[string][]source{} // slow log name => uncached ranges
+	s.mu.Lock()
+	for n, src := range sources {
+		if r, ok := s.results[src.name]; ok {
+			res[n] = r
+			continue
+		}
+		if r, ok := s.cache.get(src.key()); ok {
+			res[n] = r
+			continue
+		}
+		r, ok := s.inflight[src.key()]
+		if !ok {
+			r = &result{done: make(chan struct{})}
+			s.inflight[src.key()] = r
+			todo[src.name] = append(todo[src.name], src)
+		}
+		wait[n] = r
+	}
+	s.mu.Unlock()
+
+	for name, srcs := range todo {
+		s.process(name, srcs)
+	}
+
+	for n, r := range wait {
+		<-r.done
+		if r.err != nil {
+			return nil, r.err
+		}
+		res[n] = r.res
+	}
+	return res, nil
+}
+
+// check returns an error if the source isn't a slow log with a valid time
+// range or a saved result without one.
+func (s *Server) check(src source) error {
+	if _, ok := s.results[src.name]; ok {
+		if src.timeRange != "" {
+			return fmt.Errorf("%s is a saved result, it does not have time ranges", src.name)
+		}
+		return nil
+	}
+	if _, ok := s.files[src.name]; !ok {
+		return fmt.Errorf("unknown file: %s", src.name)
+	}
+	_, err := slowlog.ParseInterval(src.timeRange, s.p.Location)
+	return err
+}
+
+// process processes the time ranges of the slow log, which get put in
+// inflight, and caches the results.
+func (s *Server) process(name string, srcs []source) {
+	intervals := make([]slowlog.Interval, len(srcs))
+	for n, src := range srcs {
+		intervals[n], _ = slowlog.ParseInterval(src.timeRange, s.p.Location) // valid, see check
+	}
+	log.Printf("Processing %s: %d time ranges...", s.files[name], len(intervals))
+	res, err := s.p.Process(s.files[name], intervals)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, src := range srcs {
+		r := s.inflight[src.key()]
+		delete(s.inflight, src.key())
+		if err != nil {
+			r.err = err
+		} else {
+			r.res = res[n]
+			s.cache.add(src.key(), res[n])
+		}
+		close(r.done)
+	}
+}
+
+func (src source) key() string {
+	return src.name + "/" + src.timeRange
+}
+
+func (s *Server) apiSources(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.names)
+}
+
+func (s *Server) apiDelta(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	orderBy := q.Get("order-by")
+	if orderBy == "" {
+		orderBy = "qps"
+	}
+	if !validOrderBy(orderBy) {
+		http.Error(w, fmt.Sprintf("invalid order-by: %s: expected one of %s", orderBy, strings.Join(delta.OrderBy, ", ")), http.StatusBadRequest)
+		return
+	}
+	c, err := s.compare(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deltas := delta.Delta(c.metrics, orderBy)
+	writeJSON(w, report.Rows(deltas, report.NewRealIter(orderBy, c.base, c.comp, c.metrics), nil))
+}
+
+// htmlTables are the tables on the web UI, like the original text report.
+var htmlTables = []string{"qps", "load", "count", "exectime"}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	minDelta, err := floatParam(q, "min-delta", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	significance, err := floatParam(q, "significance", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := s.compare(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := indexPage{
+		Sources:      s.names,
+		Comparison:   c,
+		MinDelta:     minDelta,
+		Significance: significance,
+	}
+	for _, orderBy := range htmlTables {
+		iter := report.NewRealIter(orderBy, c.base, c.comp, c.metrics)
+		t := table{Metric: orderBy}
+		for i, d := range delta.Delta(c.metrics, orderBy) {
+			if iter.AbsDelta(d) < minDelta {
+				break // like report.Print
+			}
+			conf := iter.Confidence(d.Id)
+			if conf < significance {
+				continue
+			}
+			link := c.Values()
+			link.Set("id", d.Id)
+			t.Rows = append(t.Rows, row{
+				N:           i + 1,
+				Delta:       iter.Delta(d),
+				Base:        iter.Base(d.Id),
+				Comp:        iter.Comp(d.Id),
+				Observed:    iter.Observed(d.Id),
+				Confidence:  fmt.Sprintf("%.0f%%", conf*100),
+				Id:          d.Id,
+				Fingerprint: iter.Fingerprint(d.Id),
+				Link:        "/query?" + link.Encode(),
+			})
+		}
+		page.Tables = append(page.Tables, t)
+	}
+	if err := indexTemplate.Execute(w, page); err != nil {
+		log.Printf("cannot render index (recovering): %s", err)
+	}
+}
+
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	c, err := s.compare(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := c.metrics[id]; !ok {
+		http.Error(w, fmt.Sprintf("unknown query id: %s", id), http.StatusNotFound)
+		return
+	}
+	page := queryPage{
+		Comparison: c,
+		Back:       "/?" + c.Values().Encode(),
+	}
+	for _, orderBy := range delta.OrderBy {
+		iter := report.NewRealIter(orderBy, c.base, c.comp, c.metrics)
+		d := delta.Delta(map[string]delta.Result{id: c.metrics[id]}, orderBy)[0]
+		if page.Id == "" {
+			page.Id = id
+			page.Fingerprint = iter.Fingerprint(id)
+			page.Observed = iter.Observed(id)
+		}
+		page.Metrics = append(page.Metrics, row{
+			Metric:     orderBy,
+			Delta:      iter.Delta(d),
+			Base:       iter.Base(id),
+			Comp:       iter.Comp(id),
+			Confidence: fmt.Sprintf("%.0f%%", iter.Confidence(id)*100),
+		})
+	}
+	for _, res := range []slowlog.Result{c.comp, c.base} {
+		if class, ok := res.Class[id]; ok && class.Example != nil {
+			page.Example = class.Example.Query
+			break
+		}
+	}
+	if err := queryTemplate.Execute(w, page); err != nil {
+		log.Printf("cannot render query (recovering): %s", err)
+	}
+}
+
+func validOrderBy(orderBy string) bool {
+	for _, o := range delta.OrderBy {
+		if o == orderBy {
+			return true
+		}
+	}
+	return false
+}
+
+func floatParam(q url.Values, name string, def float64) (float64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s: %s", name, v, err)
+	}
+	return f, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("cannot write JSON (recovering): %s", err)
+	}
+}
@@ -0,0 +1,166 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/report"
+	"github.com/daniel-nichter/lab/qdelta/server"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	"github.com/go-test/deep"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServer(t *testing.T) {
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	s, err := server.New(p, []string{"../test/slowlogs/slow9001.log"}, []string{"../test/results/001-base.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// Sources are named by base name only
+	code, body := get(t, ts.URL+"/api/sources")
+	var sources []string
+	if err := json.Unmarshal([]byte(body), &sources); err != nil {
+		t.Fatalf("%s: %s", err, body)
+	}
+	got := []interface{}{code, sources}
+	expect := []interface{}{200, []string{"slow9001.log", "001-base.json"}}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Ranges of the first source, which is the default
+	code, body = get(t, ts.URL+"/api/delta?order-by=count&base=2017-01-01T00:00:00/2017-01-01T00:00:59&comp=2017-01-01T00:03:00/2017-01-01T00:03:59")
+	var rows []report.Row
+	if err := json.Unmarshal([]byte(body), &rows); err != nil {
+		t.Fatalf("%s: %s", err, body)
+	}
+	observed := []string{}
+	for _, r := range rows {
+		observed = append(observed, r.Observed)
+	}
+	got = []interface{}{code, observed}
+	expect = []interface{}{200, []string{"base", "new", "new"}}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Saved results don't have time ranges, and unknown files are not served
+	for _, q := range []string{
+		"base-file=001-base.json&base=2017-01-01T00:00:00/2017-01-01T00:00:59",
+		"base-file=/etc/passwd",
+		"order-by=foo",
+	} {
+		code, body = get(t, ts.URL+"/api/delta?"+q)
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, expected 400: %s", q, code, body)
+		}
+	}
+
+	// Web UI links fingerprints to their query page
+	code, body = get(t, ts.URL+"/?base-file=001-base.json&comp-file=slow9001.log&min-delta=0")
+	if code != 200 || !strings.Contains(body, `<a href="/query?`) {
+		t.Errorf("got %d, expected 200 with query links: %s", code, body)
+	}
+	i := strings.Index(body, `<a href="`)
+	link := strings.Replace(body[i+len(`<a href="`):strings.Index(body[i:], `">`)+i], "&amp;", "&", -1)
+	code, body = get(t, ts.URL+link)
+	if code != 200 || !strings.Contains(body, "rows-examined") {
+		t.Errorf("%s: got %d, expected 200 with every metric: %s", link, code, body)
+	}
+}
+
+func TestServerCache(t *testing.T) {
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	s, err := server.New(p, []string{"../test/slowlogs/slow9001.log"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetCacheSize(s, 2)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// Concurrent requests for the same ranges are processed once and all
+	// get the same rows
+	const url = "/api/delta?base=2017-01-01T00:00:00/2017-01-01T00:00:59&comp=2017-01-01T00:03:00/2017-01-01T00:03:59"
+	bodies := make(chan string, 4)
+	for n := 0; n < cap(bodies); n++ {
+		go func() {
+			resp, err := http.Get(ts.URL + url)
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			bodies <- string(body)
+		}()
+	}
+	first := <-bodies
+	for n := 1; n < cap(bodies); n++ {
+		if body := <-bodies; body != first {
+			t.Errorf("got different rows: %s\nvs. %s", body, first)
+		}
+	}
+
+	// Only the 2 most recently used ranges are cached
+	code, body := get(t, ts.URL+"/api/delta?base=2017-01-01T00:01:00/2017-01-01T00:01:59&comp=2017-01-01T00:03:00/2017-01-01T00:03:59")
+	if code != 200 {
+		t.Fatalf("got %d, expected 200: %s", code, body)
+	}
+	expect := []string{
+		"slow9001.log/2017-01-01T00:01:00/2017-01-01T00:01:59",
+		"slow9001.log/2017-01-01T00:03:00/2017-01-01T00:03:59",
+	}
+	if diff := deep.Equal(server.Cached(s), expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestServerInvalidSource(t *testing.T) {
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	s, err := server.New(p, []string{"../test/slowlogs/slow9001.log"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+
+	// The invalid comp source fails the request before the valid base range
+	// is processed, so a request for the base range doesn't wait for it
+	const base = "base=2017-01-01T00:00:00/2017-01-01T00:00:59"
+	code, body := get(t, ts.URL+"/api/delta?"+base+"&comp-file=bogus")
+	if code != http.StatusBadRequest {
+		t.Fatalf("got %d, expected 400: %s", code, body)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(ts.URL + "/api/delta?" + base)
+	if err != nil {
+		// Not ts.Close, which waits for the request that's stuck
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("got %d, expected 200", resp.StatusCode)
+	}
+	ts.Close()
+}
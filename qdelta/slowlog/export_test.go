@@ -0,0 +1,9 @@
+package slowlog
+
+// SetFingerprint replaces the query fingerprinter so tests can crash it, and
+// returns a func to restore it.
+func SetFingerprint(f func(string) string) func() {
+	orig := queryFingerprint
+	queryFingerprint = f
+	return func() { queryFingerprint = orig }
+}
@@ -0,0 +1,66 @@
+package slowlog
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/go-mysql/query"
+	"github.com/go-mysql/slowlog"
+)
+
+// Filter includes or excludes events by user, host, and db (schema). Each is
+// a regex (see FilterRegexp) and nil matches everything. An event must match
+// every include regex and none of the exclude (Ignore) regexes.
+type Filter struct {
+	User       *regexp.Regexp
+	Host       *regexp.Regexp
+	Db         *regexp.Regexp
+	IgnoreUser *regexp.Regexp
+	IgnoreHost *regexp.Regexp
+	IgnoreDb   *regexp.Regexp
+}
+
+// FilterRegexp compiles a Filter regex which must match the whole value, so
+// "app" matches user app but not app2. It returns nil if re is empty.
+func FilterRegexp(re string) (*regexp.Regexp, error) {
+	if re == "" {
+		return nil, nil
+	}
+	r, err := regexp.Compile("^(?:" + re + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter regex: '%s': %s", re, err)
+	}
+	return r, nil
+}
+
+// Match returns true if the event passes the filter.
+func (f Filter) Match(e slowlog.Event) bool {
+	return include(f.User, f.IgnoreUser, e.User) &&
+		include(f.Host, f.IgnoreHost, e.Host) &&
+		include(f.Db, f.IgnoreDb, e.Db)
+}
+
+func include(in, ex *regexp.Regexp, val string) bool {
+	if in != nil && !in.MatchString(val) {
+		return false
+	}
+	if ex != nil && ex.MatchString(val) {
+		return false
+	}
+	return true
+}
+
+// classId returns the class ID of the event: the query ID, or if grouping by
+// user, host, or db, the query ID and the event's value like ID@value.
+func (p *Processor) classId(fingerprint string, e slowlog.Event) string {
+	id := query.Id(fingerprint)
+	switch p.GroupBy {
+	case "user":
+		return id + "@" + e.User
+	case "host":
+		return id + "@" + e.Host
+	case "db":
+		return id + "@" + e.Db
+	}
+	return id
+}
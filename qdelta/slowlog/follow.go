@@ -0,0 +1,176 @@
+package slowlog
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-mysql/slowlog"
+)
+
+// Follower follows a slow log like tail -F: it parses new events as they're
+// written, reopens the file when it's rotated, and starts over when it's
+// truncated (i.e. it becomes smaller). Only new events are followed, not
+// events already in the file.
+type Follower struct {
+	file   string
+	poll   time.Duration
+	events chan slowlog.Event
+	stop   chan struct{}
+
+	fd      *os.File
+	fi      os.FileInfo
+	offset  uint64         // where to parse next
+	pending *slowlog.Event // last event, maybe not completely written yet
+}
+
+func NewFollower(file string, poll time.Duration) *Follower {
+	return &Follower{
+		file:   file,
+		poll:   poll,
+		events: make(chan slowlog.Event, 100),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start opens the file at its end and starts following it.
+func (f *Follower) Start() error {
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.offset = uint64(f.fi.Size())
+	go f.follow()
+	return nil
+}
+
+// Events returns the channel on which new events are sent.
+func (f *Follower) Events() <-chan slowlog.Event {
+	return f.events
+}
+
+// Stop stops following the file and closes the events channel.
+func (f *Follower) Stop() {
+	close(f.stop)
+}
+
+func (f *Follower) open() error {
+	fd, err := os.Open(f.file)
+	if err != nil {
+		return err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	f.fd = fd
+	f.fi = fi
+	f.offset = 0
+	f.pending = nil
+	return nil
+}
+
+func (f *Follower) follow() {
+	defer close(f.events)
+	defer func() {
+		f.fd.Close()
+	}()
+
+	ticker := time.NewTicker(f.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(f.file)
+		if err != nil {
+			// Probably between rotate and create new file
+			continue
+		}
+
+		if !os.SameFile(fi, f.fi) {
+			// Rotated: finish old file, then start at beginning of new file.
+			// The last event of the old file is complete now.
+			log.Printf("%s rotated", f.file)
+			if !f.parse(true) {
+				return
+			}
+			f.fd.Close()
+			if err := f.open(); err != nil {
+				log.Printf("cannot open %s (recovering): %s", f.file, err)
+				continue
+			}
+		} else if uint64(fi.Size()) < f.offset {
+			// Truncated: start over at beginning
+			log.Printf("%s truncated", f.file)
+			f.offset = 0
+			f.pending = nil
+		}
+
+		// Parse new events. If the file didn't grow, the pending event is
+		// complete.
+		grew := f.pending == nil || uint64(fi.Size()) > f.pending.OffsetEnd
+		if !f.parse(!grew) {
+			return
+		}
+	}
+}
+
+// parse parses and sends events from offset to the end of file, except the
+// last event which is kept pending because it might not be completely
+// written yet, unless final is true. It returns false if stopped.
+func (f *Follower) parse(final bool) bool {
+	if f.pending != nil && final {
+		if !f.send(*f.pending) {
+			return false
+		}
+		f.offset = f.pending.OffsetEnd
+		f.pending = nil
+	}
+
+	// The parser only seeks if StartOffset > 0, but the fd offset is wherever
+	// the last parse stopped, so always seek
+	if _, err := f.fd.Seek(int64(f.offset), io.SeekStart); err != nil {
+		log.Printf("cannot seek %s to offset %d (recovering): %s", f.file, f.offset, err)
+		return true
+	}
+	p := slowlog.NewFileParser(f.fd)
+	if err := p.Start(slowlog.Options{StartOffset: f.offset}); err != nil {
+		log.Printf("cannot parse %s at offset %d (recovering): %s", f.file, f.offset, err)
+		return true
+	}
+	defer p.Stop()
+
+	var last *slowlog.Event
+	for event := range p.Events() {
+		if last != nil && !f.send(*last) {
+			return false
+		}
+		e := event
+		last = &e
+	}
+	if last == nil {
+		return true
+	}
+	if final {
+		f.offset = last.OffsetEnd
+		return f.send(*last)
+	}
+	// Parse last event again next time
+	f.offset = last.Offset
+	f.pending = last
+	return true
+}
+
+func (f *Follower) send(e slowlog.Event) bool {
+	select {
+	case f.events <- e:
+		return true
+	case <-f.stop:
+		return false
+	}
+}
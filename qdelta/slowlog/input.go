@@ -0,0 +1,266 @@
+package slowlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// STDIN is the file name for reading the slow log from stdin.
+const STDIN = "-"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Input is one or more slow log files read as one continuous slow log. The
+// slow log parser requires an *os.File, so unless Input is one uncompressed
+// file, the files are decompressed and written to a pipe, in which case the
+// Input is not seekable.
+type Input struct {
+	*os.File
+	seekable bool
+	errChan  chan error // read error from the files written to the pipe
+}
+
+// Open opens the slow log files as one Input. Files are ordered by their first
+// timestamp, so rotated files can be given in any order, e.g. slow.log.2.gz
+// slow.log.1 slow.log. Files can be compressed with gzip or zstd (detected by
+// magic bytes or .gz and .zst extensions). STDIN reads stdin, which must be the
+// only file.
+func Open(files ...string) (*Input, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no slow log files")
+	}
+	for _, file := range files {
+		if file == STDIN && len(files) > 1 {
+			return nil, fmt.Errorf("stdin (%s) cannot be read with other files", STDIN)
+		}
+	}
+
+	if len(files) == 1 && files[0] != STDIN {
+		fd, err := os.Open(files[0])
+		if err != nil {
+			return nil, err
+		}
+		c, err := compressed(fd, files[0])
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		if !c {
+			return &Input{File: fd, seekable: true}, nil
+		}
+		fd.Close() // decompressed into pipe below
+	}
+
+	if len(files) > 1 {
+		var err error
+		if files, err = orderByTime(files); err != nil {
+			return nil, err
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	in := &Input{
+		File:    r,
+		errChan: make(chan error, 1),
+	}
+	go func() {
+		defer w.Close()
+		for _, file := range files {
+			if err := copyFile(w, file); err != nil {
+				if err == errClosed {
+					err = nil
+				}
+				in.errChan <- err
+				return
+			}
+		}
+		in.errChan <- nil
+	}()
+	return in, nil
+}
+
+// Seekable returns true if the input is one uncompressed file.
+func (in *Input) Seekable() bool {
+	return in.seekable
+}
+
+// Close closes the input and returns the first error reading the files, if
+// any. Closing before the whole input is read is not an error.
+func (in *Input) Close() error {
+	err := in.File.Close()
+	if in.errChan != nil {
+		err = <-in.errChan
+	}
+	return err
+}
+
+// errClosed is returned by copyFile when the input is closed before the file
+// is completely read, which is not an error.
+var errClosed = errors.New("input closed")
+
+// copyFile writes the decompressed file to w.
+func copyFile(w io.Writer, file string) error {
+	r, closeFn, err := open(file)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	er := &errReader{r: r}
+	tail := &tailWriter{w: w}
+	if _, err := io.Copy(tail, er); err != nil && er.err == nil {
+		return errClosed // write error
+	}
+	if er.err != nil {
+		return fmt.Errorf("cannot read %s: %s", file, er.err)
+	}
+	// Don't join the last line of one file and first line of the next
+	if tail.last != '\n' && tail.n > 0 {
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return errClosed
+		}
+	}
+	return nil
+}
+
+// open opens and decompresses the file, if needed.
+func open(file string) (io.Reader, func(), error) {
+	if file == STDIN {
+		return decompress(os.Stdin, STDIN)
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, closeFn, err := decompress(fd, file)
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	return r, func() { closeFn(); fd.Close() }, nil
+}
+
+func decompress(r io.Reader, file string) (io.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read %s: %s", file, err)
+		}
+		return gz, func() { gz.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read %s: %s", file, err)
+		}
+		return zr, zr.Close, nil
+	case strings.HasSuffix(file, ".gz") || strings.HasSuffix(file, ".zst"):
+		if len(magic) > 0 {
+			return nil, nil, fmt.Errorf("%s is not compressed as its extension says", file)
+		}
+	}
+	return br, func() {}, nil // uncompressed
+}
+
+// compressed returns true if the file is compressed with gzip or zstd. The
+// file offset is reset to the beginning.
+func compressed(fd *os.File, file string) (bool, error) {
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(fd, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return bytes.HasPrefix(magic[:n], gzipMagic) || bytes.HasPrefix(magic[:n], zstdMagic) ||
+		strings.HasSuffix(file, ".gz") || strings.HasSuffix(file, ".zst"), nil
+}
+
+// orderByTime returns the files ordered by the first timestamp in each.
+// Files without a timestamp are first, in the given order.
+func orderByTime(files []string) ([]string, error) {
+	first := map[string]time.Time{}
+	for _, file := range files {
+		ts, err := firstTs(file)
+		if err != nil {
+			return nil, err
+		}
+		first[file] = ts
+	}
+	ordered := append([]string(nil), files...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return first[ordered[i]].Before(first[ordered[j]])
+	})
+	log.Printf("slow log files in time order: %s", strings.Join(ordered, " "))
+	return ordered, nil
+}
+
+// firstTs returns the first "# Time:" ts in the file, or zero time if none.
+func firstTs(file string) (time.Time, error) {
+	r, closeFn, err := open(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer closeFn()
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024) // long queries
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "# Time: ") {
+			continue
+		}
+		if ts, err := parseTs(strings.TrimSpace(line[8:]), time.UTC); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, s.Err()
+}
+
+// errReader saves the first read error that's not EOF.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// tailWriter saves the last byte written.
+type tailWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.n += int64(n)
+		w.last = p[n-1]
+	}
+	return n, err
+}
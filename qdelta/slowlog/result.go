@@ -0,0 +1,208 @@
+package slowlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/go-mysql/slowlog"
+)
+
+// Save writes the result to file as JSON so it can be loaded later instead
+// of processing the slow log again, e.g. a known-good baseline.
+func Save(file string, res Result) error {
+	bytes, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(bytes, '\n'), 0644)
+}
+
+// Load reads a result saved by Save.
+func Load(file string) (Result, error) {
+	var res Result
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(bytes, &res)
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// Combine combines results into one result, as if their events had been
+// aggregated together. Counts and sums are exact, but medians and 95th
+// percentiles are count-weighted averages because the values are gone.
+// Begin and End are the earliest Begin and latest End, SampleRate and
+// ClassSampleRate are the averages of each result's weighted by its queries,
+// and SumsOnly is true if any result's is. The results are not modified.
+func Combine(results ...Result) Result {
+	res := Result{
+		Result: slowlog.Result{
+			Global: &slowlog.Class{Metrics: slowlog.NewMetrics()},
+			Class:  map[string]*slowlog.Class{},
+		},
+	}
+	var all, classes rates // global and class counts overlap, so count apart
+	for _, r := range results {
+		if r.Global != nil {
+			n := float64(r.Global.TotalQueries)
+			all.add("", n, n*r.Rate())
+		}
+		if !r.Begin.IsZero() && (res.Begin.IsZero() || r.Begin.Before(res.Begin)) {
+			res.Begin = r.Begin
+		}
+		if r.End.After(res.End) {
+			res.End = r.End
+		}
+		if r.SumsOnly {
+			res.SumsOnly = true
+		}
+		if r.RateLimit > res.RateLimit {
+			res.RateLimit = r.RateLimit
+		}
+		if r.Global != nil {
+			combineClass(res.Global, r.Global)
+		}
+		for id, class := range r.Class {
+			c, ok := res.Class[id]
+			if !ok {
+				c = &slowlog.Class{
+					Id:          class.Id,
+					User:        class.User,
+					Db:          class.Db,
+					Fingerprint: class.Fingerprint,
+					Metrics:     slowlog.NewMetrics(),
+				}
+				res.Class[id] = c
+			}
+			combineClass(c, class)
+			n := float64(class.TotalQueries)
+			classes.add(id, n, n*r.ClassRate(id))
+		}
+	}
+	res.Global.UniqueQueries = uint(len(res.Class))
+	res.SampleRate = all.rate()
+	if res.SampleRate > 0 {
+		res.ClassSampleRate = classes.classRates()
+	}
+	return res
+}
+
+// Regroup returns the result with its classes combined into new classes by
+// key: each class is added to every class returned by keys, like a query
+// that joins two tables added to both tables. The new classes have the key as
+// their ID and fingerprint, and UniqueQueries is how many classes were added
+// to them. Global is the same, so the new classes can sum to
+// more than global. Medians and 95th percentiles are averaged like Combine,
+// and ClassSampleRate too. The result is not modified.
+func Regroup(res Result, keys func(*slowlog.Class) []string) Result {
+	var r rates
+	regrouped := res
+	regrouped.Global = &slowlog.Class{Metrics: slowlog.NewMetrics()}
+	regrouped.Class = map[string]*slowlog.Class{}
+	if res.Global != nil {
+		combineClass(regrouped.Global, res.Global)
+	}
+	for id, class := range res.Class {
+		n := float64(class.TotalQueries)
+		for _, key := range keys(class) {
+			r.add(key, n, n*res.ClassRate(id))
+			c, ok := regrouped.Class[key]
+			if !ok {
+				c = &slowlog.Class{
+					Id:          key,
+					Fingerprint: key,
+					Metrics:     slowlog.NewMetrics(),
+				}
+				regrouped.Class[key] = c
+			}
+			n := c.UniqueQueries
+			combineClass(c, class)
+			c.UniqueQueries = n + 1
+		}
+	}
+	regrouped.Global.UniqueQueries = uint(len(regrouped.Class))
+	regrouped.ClassSampleRate = nil
+	if res.SampleRate > 0 {
+		regrouped.ClassSampleRate = r.classRates()
+	}
+	return regrouped
+}
+
+func combineClass(dst, src *slowlog.Class) {
+	dst.TotalQueries += src.TotalQueries
+	if src.UniqueQueries > dst.UniqueQueries {
+		dst.UniqueQueries = src.UniqueQueries
+	}
+	if src.Example != nil && (dst.Example == nil || src.Example.QueryTime > dst.Example.QueryTime) {
+		e := *src.Example
+		dst.Example = &e
+	}
+	if src.Metrics == nil {
+		return
+	}
+	for k, s := range src.Metrics.TimeMetrics {
+		d, ok := dst.Metrics.TimeMetrics[k]
+		if !ok {
+			d = &slowlog.TimeStats{}
+			dst.Metrics.TimeMetrics[k] = d
+		}
+		combineTime(d, s)
+	}
+	for k, s := range src.Metrics.NumberMetrics {
+		d, ok := dst.Metrics.NumberMetrics[k]
+		if !ok {
+			d = &slowlog.NumberStats{}
+			dst.Metrics.NumberMetrics[k] = d
+		}
+		combineNumber(d, s)
+	}
+	for k, s := range src.Metrics.BoolMetrics {
+		d, ok := dst.Metrics.BoolMetrics[k]
+		if !ok {
+			d = &slowlog.BoolStats{}
+			dst.Metrics.BoolMetrics[k] = d
+		}
+		d.Sum += s.Sum
+	}
+}
+
+func combineTime(dst, src *slowlog.TimeStats) {
+	if src.Cnt == 0 {
+		return
+	}
+	if dst.Cnt == 0 || src.Min < dst.Min {
+		dst.Min = src.Min
+	}
+	if src.Max > dst.Max {
+		dst.Max = src.Max
+	}
+	w := float64(dst.Cnt)
+	n := float64(src.Cnt)
+	dst.Med = (dst.Med*w + src.Med*n) / (w + n)
+	dst.P95 = (dst.P95*w + src.P95*n) / (w + n)
+	dst.Sum += src.Sum
+	dst.Cnt += src.Cnt
+	dst.Avg = dst.Sum / float64(dst.Cnt)
+}
+
+func combineNumber(dst, src *slowlog.NumberStats) {
+	if src.Cnt == 0 {
+		return
+	}
+	if dst.Cnt == 0 || src.Min < dst.Min {
+		dst.Min = src.Min
+	}
+	if src.Max > dst.Max {
+		dst.Max = src.Max
+	}
+	w := uint64(dst.Cnt)
+	n := uint64(src.Cnt)
+	dst.Med = (dst.Med*w + src.Med*n) / (w + n)
+	dst.P95 = (dst.P95*w + src.P95*n) / (w + n)
+	dst.Sum += src.Sum
+	dst.Cnt += src.Cnt
+	dst.Avg = dst.Sum / uint64(dst.Cnt)
+}
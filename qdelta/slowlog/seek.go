@@ -0,0 +1,81 @@
+package slowlog
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// seekTime returns the byte offset of the first "# Time:" line in the slow
+// log file with a ts at or after since. Slow logs are ordered by time, so
+// this is a binary search on byte offsets, which is a lot faster than parsing
+// every event before since when since is near the end of a large file. If
+// no ts is at or after since, the size of the file is returned. Timestamps
+// without a time zone are in loc.
+func seekTime(file *os.File, since time.Time, loc *time.Location) (uint64, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		off, ts, err := nextTime(file, mid, size, loc)
+		if err != nil {
+			return 0, err
+		}
+		if off == size || !ts.Before(since) {
+			hi = mid
+		} else {
+			// Every "# Time:" line at or before off is before since
+			lo = off + 1
+		}
+	}
+	off, _, err := nextTime(file, lo, size, loc)
+	return uint64(off), err
+}
+
+// nextTime returns the byte offset and ts of the first "# Time:" line that
+// begins at or after offset off. If there's no such line, size is returned.
+// Lines with invalid timestamps are skipped.
+func nextTime(file *os.File, off, size int64, loc *time.Location) (int64, time.Time, error) {
+	// Start reading one byte before off so that if off is the start of a
+	// line, the preceding newline is read and the line is not skipped as a
+	// partial line. The checks are on off, not start: if off is 1, start is
+	// 0 but the line at 0 is still partial.
+	start := off
+	if off > 0 {
+		start--
+	}
+	r := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+	pos := start
+	if off > 0 {
+		// Skip partial line
+		line, err := r.ReadString('\n')
+		pos += int64(len(line))
+		if err == io.EOF {
+			return size, time.Time{}, nil
+		} else if err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, "# Time: ") {
+			ts, perr := parseTs(strings.TrimSpace(line[8:]), loc)
+			if perr == nil {
+				return pos, ts, nil
+			}
+		}
+		pos += int64(len(line))
+		if err == io.EOF {
+			return size, time.Time{}, nil
+		} else if err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+}
@@ -1,143 +1,490 @@
 package slowlog
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-mysql/query"
 	"github.com/go-mysql/slowlog"
 )
 
-const SLOWLOG_TS_FORMAT = "060102 15:04:05" // YYMMDD
+const (
+	SLOWLOG_TS_FORMAT     = "060102 15:04:05"                     // YYMMDD, MySQL 5.6 and older, server time zone
+	SLOWLOG_ISO_TS_FORMAT = "2006-01-02T15:04:05.999999999Z07:00" // MySQL 5.7 and newer, log_timestamps
+)
 
+// Interval is a time range in a slow log file. A zero Since or Until means
+// the range is unbounded on that side, so a zero Interval is the whole file.
 type Interval struct {
-	File  string
 	Since time.Time
 	Until time.Time
 }
 
+// ParseInterval parses a time range like 2017-01-01T00:00:00/2017-01-01T01:00:00
+// in time zone loc (nil is UTC). Fractional seconds are optional. An empty time
+// range is the whole file.
+func ParseInterval(timeRange string, loc *time.Location) (Interval, error) {
+	var i Interval
+	if timeRange == "" {
+		return i, nil
+	}
+	t := strings.Split(timeRange, "/")
+	if len(t) != 2 {
+		return i, fmt.Errorf("invalid time range: '%s': split returned %d timestamps, expected 2",
+			timeRange, len(t))
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	since, err := time.ParseInLocation("2006-01-02T15:04:05", t[0], loc)
+	if err != nil {
+		return i, fmt.Errorf("invalid timestamp: '%s': %s", t[0], err)
+	}
+	until, err := time.ParseInLocation("2006-01-02T15:04:05", t[1], loc)
+	if err != nil {
+		return i, fmt.Errorf("invalid timestamp: '%s': %s", t[1], err)
+	}
+	i.Since = since
+	i.Until = until
+	return i, nil
+}
+
 type Result struct {
 	Begin time.Time // actual vs. Since, used to calc QPS
 	End   time.Time // actual vs. Until, used to calc QPS
 	slowlog.Result
+
+	// SampleRate is how many real queries each logged event represents
+	// when the slow log is sampled (log_slow_rate_limit), e.g. 10 if 1 of
+	// every 10 queries was logged. Zero means not sampled, same as 1.
+	// Counts and sums are not scaled; use Rate to scale them.
+	SampleRate float64 `json:",omitempty"`
+
+	// ClassSampleRate is the SampleRate of each class, keyed on class ID,
+	// if the result is sampled. Classes differ because outliers are always
+	// logged (see sampleRate). Use ClassRate to scale class counts and sums.
+	ClassSampleRate map[string]float64 `json:",omitempty"`
+
+	// SumsOnly is true if the classes only have counts and sums, like
+	// performance_schema digests, so their medians and 95th percentiles
+	// don't describe the distribution of values between Begin and End.
+	SumsOnly bool `json:",omitempty"`
+}
+
+// Rate returns SampleRate, or 1 if the result is not sampled.
+func (r Result) Rate() float64 {
+	if r.SampleRate <= 0 {
+		return 1
+	}
+	return r.SampleRate
+}
+
+// ClassRate returns the ClassSampleRate of the class, or Rate if it doesn't
+// have one, e.g. a result saved without them or with -base-rate.
+func (r Result) ClassRate(id string) float64 {
+	if rate, ok := r.ClassSampleRate[id]; ok && rate > 0 {
+		return rate
+	}
+	return r.Rate()
 }
 
 type Processor struct {
-	utcOffset   time.Duration // UTC offset in hours for the system time zone
+	utcOffset   time.Duration // added to example timestamps, see NewProcessor
 	outlierTime float64       // @@global.slow_query_log_always_write_time
+	workers     int           // number of fingerprinter goroutines
+
+	// Filter filters events before they're aggregated. The zero value
+	// includes every event.
+	Filter Filter
+
+	// GroupBy is user, host, or db to aggregate each query separately per
+	// value, else empty to aggregate by query only. See classId.
+	GroupBy string
+
+	// Location is the time zone of slow log timestamps without one, which
+	// is the MySQL server time zone. Result times are in it too. Nil is UTC.
+	Location *time.Location
+
+	// NewParser returns the parser of other inputs with events like the slow
+	// log, e.g. general logs. Nil is the slow log parser.
+	NewParser func(*os.File) slowlog.Parser
+
+	// Unordered is true if the parser's events aren't in ts order, e.g.
+	// pcap events are sent when the response ends. Then an event after an
+	// interval's Until doesn't end the interval, so processing doesn't stop
+	// early.
+	Unordered bool
 }
 
-func NewProcessor(utcOffset time.Duration, outlierTime float64) *Processor {
+// NewProcessor returns a processor. utcOffset is added to the UTC example
+// timestamps of query classes (see slowlog.Aggregator). It's one offset for
+// every timestamp, so it's usually zero: timestamps are converted to UTC from
+// Location, each with its own offset, which changes at DST changes.
+func NewProcessor(utcOffset time.Duration, outlierTime float64, workers int) *Processor {
+	if workers < 1 {
+		workers = 1
+	}
 	return &Processor{
 		utcOffset:   utcOffset,
 		outlierTime: outlierTime,
+		workers:     workers,
 	}
 }
 
-func (p *Processor) Process(i Interval) (Result, error) {
-	res := Result{}
+// Process reads the slow log file once and aggregates its events into each
+// interval, returning one Result per interval in the same order. Intervals
+// can overlap. Processing stops early when every interval has ended (i.e.
+// the slow log has an event after every interval's Until), unless the
+// processor is Unordered. The file can be compressed or STDIN; see Open.
+func (p *Processor) Process(file string, intervals []Interval) ([]Result, error) {
+	return p.ProcessFiles([]string{file}, intervals)
+}
 
-	file, err := os.Open(i.File)
+// ProcessFiles is like Process but reads the files as one continuous slow
+// log; see Open.
+func (p *Processor) ProcessFiles(files []string, intervals []Interval) (res []Result, err error) {
+	fd, err := Open(files...)
 	if err != nil {
-		return res, err
+		return nil, err
 	}
-	defer file.Close() // don't leak fd
+	defer func() {
+		// Don't leak fd, and a read error means the results are incomplete
+		if cerr := fd.Close(); cerr != nil && err == nil {
+			res, err = nil, cerr
+		}
+	}()
 
-	// Run fingerprinter in goroutine in case it crashes.
-	queryChan := make(chan string, 1)
-	fingerprintChan := make(chan string, 1)
-	crashChan := make(chan interface{}, 1)
-	go p.fingerprinter(queryChan, fingerprintChan, crashChan)
-	defer close(queryChan) // stop that ^ goroutine
+	// Use an aggregator per interval to group events by fingerprint and
+	// calculate stats.
+	all := make([]*interval, len(intervals))
+	for n, i := range intervals {
+		all[n] = &interval{
+			Interval: i,
+			a:        slowlog.NewAggregator(true, p.utcOffset, p.outlierTime),
+		}
+	}
+	in := make([]*interval, 0, len(all)) // intervals that current event is in
 
-	// Use aggregator to group events by fingerprint and calculate stats.
-	a := slowlog.NewAggregator(true, p.utcOffset, p.outlierTime)
+	// Skip events before the earliest since, if there is one.
+	opts := slowlog.Options{}
+	if since := earliest(intervals); !since.IsZero() && fd.Seekable() && p.NewParser == nil {
+		off, err := seekTime(fd.File, since, p.location())
+		if err != nil {
+			log.Printf("cannot seek to %s (recovering): %s", since, err)
+		} else {
+			log.Printf("first event since %s at offset %d", since, off)
+			opts.StartOffset = off
+		}
+	}
 
 	// Run slow log parser, recv events from its EventChan().
-	slp := slowlog.NewFileParser(file)
-	if err := slp.Start(slowlog.Options{}); err != nil {
-		return res, err
+	var slp slowlog.Parser = slowlog.NewFileParser(fd.File)
+	if p.NewParser != nil {
+		slp = p.NewParser(fd.File)
+	}
+	if err := slp.Start(opts); err != nil {
+		return nil, err
 	}
 	defer slp.Stop()
 
-	var (
-		firstEvent *slowlog.Event
-		lastEvent  *slowlog.Event
-	)
+	// Fingerprinting is the slowest part, so a pool of fingerprinters work
+	// on events in parallel, and the aggregator waits for each event's
+	// fingerprint in order so that events are aggregated in slow log order.
+	jobChan := make(chan *job, p.workers)
+	orderChan := make(chan *job, p.workers*2)
+	doneChan := make(chan struct{})
+	for n := 0; n < p.workers; n++ {
+		go p.fingerprinter(jobChan)
+	}
+	go p.aggregator(orderChan, doneChan)
+
+	// ts of last event with a ts. Several events can have the same ts, in
+	// which case only the first has a "# Time:" line, so events without a ts
+	// presumably happened at this time.
+	var lastTs time.Time
 
 	for event := range slp.Events() {
-		var ts time.Time
-		var err error
 		if event.Ts == "" {
-			if firstEvent == nil {
+			if lastTs.IsZero() {
 				continue // keep looking for known start ts
 			}
-
-			// At some time after since, so presume this event which has no ts
-			// is also before until
 		} else {
-			// Filter out events not in [since, until)
-			ts, err = time.Parse(SLOWLOG_TS_FORMAT, event.Ts)
+			ts, err := parseTs(event.Ts, p.location())
 			if err != nil {
 				log.Printf("invalid slow log timestamp (recovering): %s: %s", event.Ts, err)
 				continue
 			}
-			if ts.Before(i.Since) {
+			lastTs = ts
+			event.Ts = utcTs(ts)
+		}
+
+		// After lastTs because events without a ts that pass the filter
+		// happened at the ts of an event that didn't pass
+		if !p.Filter.Match(event) {
+			continue
+		}
+
+		// Filter out intervals that event is not in
+		in = in[:0]
+		done := true
+		for _, i := range all {
+			if i.done {
+				continue
+			}
+			if lastTs.Before(i.Since) {
+				done = false
 				continue
 			}
-			if ts.After(i.Until) {
-				if lastEvent != nil && lastEvent.Ts != "" {
-					// Can ignore err here because we already parsed event ts ^
-					ts, _ := time.Parse(SLOWLOG_TS_FORMAT, lastEvent.Ts)
-					res.End = ts
+			if !i.Until.IsZero() && lastTs.After(i.Until) {
+				if p.Unordered {
+					done = false // earlier events can follow
 				} else {
-					ts, err := time.Parse(SLOWLOG_TS_FORMAT, event.Ts)
-					if err != nil {
-						log.Printf("invalid slow log timestamp (recovering): %s: %s", event.Ts, err)
-						ts = i.Until
-					}
-					res.End = ts
+					i.finish(lastTs)
 				}
-				log.Printf("last event at %s", res.End)
-				break
+				continue
 			}
+			done = false
+			in = append(in, i)
 		}
-
-		// Event is in [since, until), fingerprint and save it
-		queryChan <- event.Query
-		select {
-		case fingerprint := <-fingerprintChan:
-			id := query.Id(fingerprint)
-			a.AddEvent(event, id, fingerprint)
-		case err := <-crashChan:
-			log.Printf("fingerprinter crashed (recovering): %s: %s", err, event.Query)
-			go p.fingerprinter(queryChan, fingerprintChan, crashChan)
+		if done {
+			log.Printf("all intervals done at %s", lastTs)
+			break
+		}
+		if len(in) == 0 {
+			continue
 		}
 
-		// Save first and last events so we can determine actual begin and end
-		// times of the interval. Slow log isn't guaranteed to have the full
-		// time range ([since, until)).
-		if firstEvent == nil {
-			log.Printf("first event at %s", ts)
-			firstEvent = &event
-			res.Begin = ts
+		// Event is in at least one interval, fingerprint it once and save it
+		// in every interval
+		j := &job{
+			event: event,
+			ts:    lastTs,
+			in:    append([]*interval(nil), in...),
+			done:  make(chan struct{}),
 		}
-		lastEvent = &event
+		orderChan <- j // first so aggregator waits for it in order
+		jobChan <- j
 	}
 
+	// Stop the fingerprinters and wait for the aggregator to finish the
+	// events already sent
+	close(jobChan)
+	close(orderChan)
+	<-doneChan
+
 	// Calculate global and class metric stats, get final results.
-	res.Result = a.Finalize()
+	res = make([]Result, len(all))
+	for n, i := range all {
+		res[n] = i.finalize()
+	}
 	return res, nil
 }
 
-func (p *Processor) fingerprinter(in, out chan string, crash chan interface{}) {
-	defer func() {
-		if err := recover(); err != nil {
-			crash <- err
+// job is one event at ts to fingerprint and aggregate into intervals in.
+// A fingerprinter sets id and fingerprint, or crash if fingerprinting
+// the query crashed, then closes done.
+type job struct {
+	event       slowlog.Event
+	ts          time.Time
+	in          []*interval
+	id          string
+	fingerprint string
+	crash       interface{}
+	done        chan struct{}
+}
+
+func (p *Processor) fingerprinter(jobs <-chan *job) {
+	for j := range jobs {
+		j.fingerprint, j.crash = fingerprint(j.event.Query)
+		if j.crash == nil {
+			j.id = p.classId(j.fingerprint, j.event)
 		}
+		close(j.done)
+	}
+}
+
+// fingerprint returns the fingerprint of q, or the value recovered from a
+// panic if the fingerprinter crashes on q.
+func fingerprint(q string) (f string, crash interface{}) {
+	defer func() {
+		crash = recover()
 	}()
-	for q := range in {
-		out <- query.Fingerprint(q)
+	return queryFingerprint(q), nil
+}
+
+var queryFingerprint = query.Fingerprint
+
+func (p *Processor) aggregator(jobs <-chan *job, doneChan chan struct{}) {
+	defer close(doneChan)
+	for j := range jobs {
+		<-j.done
+		if j.crash != nil {
+			log.Printf("fingerprinter crashed (recovering): %s: %s", j.crash, j.event.Query)
+			continue
+		}
+		rate := p.sampleRate(&j.event)
+		for _, i := range j.in {
+			i.seen(j.ts)
+			i.a.AddEvent(j.event, j.id, j.fingerprint)
+			i.rates.add(j.id, 1, rate)
+		}
+	}
+}
+
+func (p *Processor) location() *time.Location {
+	if p.Location == nil {
+		return time.UTC
+	}
+	return p.Location
+}
+
+// sampleRate returns how many real queries the event represents: its
+// Log_slow_rate_limit, or 1 if it's not sampled or it's an outlier, which is
+// always logged (slow_query_log_always_write_time). It zeroes the event's
+// rate limit so the aggregator doesn't scale it, too.
+func (p *Processor) sampleRate(e *slowlog.Event) float64 {
+	limit := e.RateLimit
+	e.RateLimit = 0
+	if limit <= 1 || (p.outlierTime > 0 && e.TimeMetrics["Query_time"] > p.outlierTime) {
+		return 1
+	}
+	return float64(limit)
+}
+
+// parseTs parses a slow log event ts in either format, keeping microseconds.
+// Timestamps without a time zone are in loc, and the result is in loc.
+func parseTs(ts string, loc *time.Location) (time.Time, error) {
+	if strings.Contains(ts, "T") {
+		t, err := time.Parse(SLOWLOG_ISO_TS_FORMAT, ts)
+		if err != nil {
+			// log_timestamps=SYSTEM without a zone
+			t, err = time.ParseInLocation("2006-01-02T15:04:05.999999999", ts, loc)
+		}
+		return t.In(loc), err
+	}
+	// Hour is space-padded, like "170101  0:00:00"
+	return time.ParseInLocation(SLOWLOG_TS_FORMAT, strings.Join(strings.Fields(ts), " "), loc)
+}
+
+// utcTs returns ts in UTC in the old slow log ts format, which is how the
+// aggregator expects example timestamps.
+func utcTs(ts time.Time) string {
+	return ts.UTC().Format(SLOWLOG_TS_FORMAT)
+}
+
+// earliest returns the earliest Since of the intervals, or zero time if any
+// interval is unbounded.
+func earliest(intervals []Interval) time.Time {
+	var since time.Time
+	for n, i := range intervals {
+		if i.Since.IsZero() {
+			return time.Time{}
+		}
+		if n == 0 || i.Since.Before(since) {
+			since = i.Since
+		}
+	}
+	return since
+}
+
+// interval aggregates the events in one Interval. Only the aggregator uses
+// a, rates, and res and lastTs until finalize, and only Process uses done
+// and doneTs.
+type interval struct {
+	Interval
+	a      *slowlog.Aggregator
+	rates  rates
+	res    Result
+	lastTs time.Time // latest ts of events aggregated in interval
+	done   bool      // true after first event after Until
+	doneTs time.Time // ts of first event after Until
+}
+
+func (i *interval) seen(ts time.Time) {
+	// Save earliest and latest event ts so we can determine actual begin and
+	// end times of the interval. Slow log isn't guaranteed to have the full
+	// time range ([since, until)), and events can be out of order (see
+	// Processor.Unordered).
+	if i.res.Begin.IsZero() || ts.Before(i.res.Begin) {
+		i.res.Begin = ts
+	}
+	if ts.After(i.lastTs) {
+		i.lastTs = ts
+	}
+}
+
+func (i *interval) finish(ts time.Time) {
+	i.done = true
+	i.doneTs = ts
+}
+
+func (i *interval) finalize() Result {
+	// If the slow log ended before until (or until is unbounded), the
+	// interval actually ended at its last event
+	i.res.End = i.lastTs
+	if i.done && i.lastTs.IsZero() {
+		i.res.End = i.doneTs // no events in interval
+	}
+	log.Printf("first event at %s, last event at %s", i.res.Begin, i.res.End)
+	i.res.Result = i.a.Finalize()
+	i.res.SampleRate = i.rates.rate()
+	i.res.ClassSampleRate = i.rates.classRates()
+	return i.res
+}
+
+// sampleRate returns the average number of real queries each event
+// represents, or zero if none were sampled.
+func sampleRate(events, queries float64) float64 {
+	if events == 0 || queries == events {
+		return 0
+	}
+	return queries / events
+}
+
+// rates counts events and the real queries they represent, in total and per
+// class, to calculate sampling rates. The zero value is ready to use.
+type rates struct {
+	events  float64
+	queries float64
+	class   map[string]*rates
+}
+
+// add adds events of the class that represent queries.
+func (r *rates) add(id string, events, queries float64) {
+	r.events += events
+	r.queries += queries
+	if r.class == nil {
+		r.class = map[string]*rates{}
+	}
+	c, ok := r.class[id]
+	if !ok {
+		c = &rates{}
+		r.class[id] = c
+	}
+	c.events += events
+	c.queries += queries
+}
+
+// rate returns the SampleRate of all events.
+func (r *rates) rate() float64 {
+	return sampleRate(r.events, r.queries)
+}
+
+// classRates returns the ClassSampleRate of each class, or nil if none were
+// sampled.
+func (r *rates) classRates() map[string]float64 {
+	if r.rate() == 0 {
+		return nil
+	}
+	classRates := make(map[string]float64, len(r.class))
+	for id, c := range r.class {
+		classRates[id] = 1
+		if rate := c.rate(); rate > 0 {
+			classRates[id] = rate
+		}
 	}
+	return classRates
 }
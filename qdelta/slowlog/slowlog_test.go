@@ -0,0 +1,734 @@
+package slowlog_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daniel-nichter/lab/qdelta/genlog"
+	"github.com/daniel-nichter/lab/qdelta/pcap"
+	"github.com/daniel-nichter/lab/qdelta/slowlog"
+	"github.com/go-mysql/query"
+	gomysql "github.com/go-mysql/slowlog"
+	"github.com/go-test/deep"
+	"github.com/klauspost/compress/zstd"
+)
+
+func ts(s string) time.Time {
+	t, err := time.Parse("2006-01-02T15:04:05", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestProcessIntervals(t *testing.T) {
+	// One pass over the file for three intervals, two of which overlap
+	intervals := []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:00:59")},
+		{Since: ts("2017-01-01T00:01:00"), Until: ts("2017-01-01T00:02:59")},
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:01:59")},
+	}
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	res, err := p.Process("../test/slowlogs/slow9001.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(intervals) {
+		t.Fatalf("got %d results, expected %d", len(res), len(intervals))
+	}
+
+	// [begin, end, total queries]
+	expect := [][]interface{}{
+		{ts("2017-01-01T00:00:00"), ts("2017-01-01T00:00:03"), uint(4)},
+		{ts("2017-01-01T00:01:00"), ts("2017-01-01T00:02:03"), uint(8)},
+		{ts("2017-01-01T00:00:00"), ts("2017-01-01T00:01:03"), uint(8)},
+	}
+	for i, r := range res {
+		got := []interface{}{r.Begin, r.End, r.Global.TotalQueries}
+		if diff := deep.Equal(got, expect[i]); diff != nil {
+			for _, d := range diff {
+				t.Errorf("interval %d: %s", i, d)
+			}
+		}
+	}
+}
+
+func TestProcessWholeFile(t *testing.T) {
+	// Zero interval is the whole file, and the slow log has events without
+	// a ts which happened at the same time as the last event with a ts
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	res, err := p.Process("../test/slowlogs/slow9002-qps.log", []slowlog.Interval{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries}
+	expect := []interface{}{ts("2017-01-01T00:00:00"), ts("2017-01-01T00:04:01"), uint(25)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestProcessSeek(t *testing.T) {
+	// Since is near the end of the file, so processing starts at the first
+	// "# Time:" at or after since, which several events have
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	intervals := []slowlog.Interval{
+		{Since: ts("2017-01-01T00:03:03"), Until: ts("2017-01-01T00:03:59")},
+	}
+	res, err := p.Process("../test/slowlogs/slow9001.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries}
+	expect := []interface{}{ts("2017-01-01T00:03:03"), ts("2017-01-01T00:03:04"), uint(8)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+
+	// Since is after the last event
+	intervals = []slowlog.Interval{
+		{Since: ts("2017-01-01T01:00:00"), Until: ts("2017-01-01T02:00:00")},
+	}
+	res, err = p.Process("../test/slowlogs/slow9001.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Global.TotalQueries != 0 {
+		t.Errorf("got %d queries, expected 0", res[0].Global.TotalQueries)
+	}
+
+	// The first "# Time:" (offset 0) is before since and the second is at
+	// since, so the search ends at offset 1, which must skip the first line
+	intervals = []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:01"), Until: ts("2017-01-01T00:00:59")},
+	}
+	res, err = p.Process("../test/slowlogs/slow9001.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries}
+	expect = []interface{}{ts("2017-01-01T00:00:01"), ts("2017-01-01T00:00:03"), uint(3)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestProcessCrash(t *testing.T) {
+	// The first and last events in the interval crash the fingerprinter,
+	// so they're not aggregated and don't count toward Begin and End
+	restore := slowlog.SetFingerprint(func(q string) string {
+		if strings.Contains(q, "crash") {
+			panic("crash")
+		}
+		return query.Fingerprint(q)
+	})
+	defer restore()
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	intervals := []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:00:59")},
+	}
+	res, err := p.Process("../test/slowlogs/slow9007-crash.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries}
+	expect := []interface{}{ts("2017-01-01T00:00:01"), ts("2017-01-01T00:00:02"), uint(2)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	res, err := p.Process("../test/slowlogs/slow9002-qps.log", []slowlog.Interval{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "qdelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "base.json")
+
+	if err := slowlog.Save(file, res[0]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := slowlog.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty metric maps are omitted, so compare JSON
+	gotJSON, _ := json.Marshal(got)
+	expectJSON, _ := json.Marshal(res[0])
+	if diff := deep.Equal(string(gotJSON), string(expectJSON)); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestStreamCombine(t *testing.T) {
+	fd, err := os.Open("../test/slowlogs/slow9001.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	slp := gomysql.NewFileParser(fd)
+	if err := slp.Start(gomysql.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer slp.Stop()
+
+	// The last bucket (00:04) is incomplete, so it's not sent
+	p := slowlog.NewProcessor(time.Duration(0), 10, 1)
+	buckets := []slowlog.Result{}
+	for res := range p.Stream(slp.Events(), time.Minute) {
+		buckets = append(buckets, res)
+	}
+	got := [][]interface{}{}
+	for _, r := range buckets {
+		got = append(got, []interface{}{r.Begin, r.End, r.Global.TotalQueries})
+	}
+	expect := [][]interface{}{
+		{ts("2017-01-01T00:00:00"), ts("2017-01-01T00:01:00"), uint(4)},
+		{ts("2017-01-01T00:01:00"), ts("2017-01-01T00:02:00"), uint(4)},
+		{ts("2017-01-01T00:02:00"), ts("2017-01-01T00:03:00"), uint(4)},
+		{ts("2017-01-01T00:03:00"), ts("2017-01-01T00:04:00"), uint(11)},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+
+	// Combining buckets is the same as processing them as one interval,
+	// except for approximate median and 95th percentile
+	res := slowlog.Combine(buckets...)
+	got1 := []interface{}{res.Begin, res.End, res.Global.TotalQueries, len(res.Class)}
+	expect1 := []interface{}{ts("2017-01-01T00:00:00"), ts("2017-01-01T00:04:00"), uint(23), 3}
+	if diff := deep.Equal(got1, expect1); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+	all, err := p.Process("../test/slowlogs/slow9001.log", []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:03:59")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qt := res.Global.Metrics.TimeMetrics["Query_time"]
+	expectQt := all[0].Global.Metrics.TimeMetrics["Query_time"]
+	got2 := []interface{}{qt.Sum, qt.Cnt, qt.Min, qt.Avg, qt.Max}
+	expect2 := []interface{}{expectQt.Sum, expectQt.Cnt, expectQt.Min, expectQt.Avg, expectQt.Max}
+	if diff := deep.Equal(got2, expect2); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestStreamPartialBucket(t *testing.T) {
+	fd, err := os.Open("../test/slowlogs/slow9001.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	slp := gomysql.NewFileParser(fd)
+	if err := slp.Start(gomysql.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer slp.Stop()
+
+	// Events start at 00:00:01, partway through the first bucket, so it
+	// begins there, not at 00:00:00
+	events := make(chan gomysql.Event)
+	go func() {
+		defer close(events)
+		<-slp.Events()
+		for e := range slp.Events() {
+			events <- e
+		}
+	}()
+	p := slowlog.NewProcessor(time.Duration(0), 10, 1)
+	got := [][]interface{}{}
+	for r := range p.Stream(events, time.Minute) {
+		got = append(got, []interface{}{r.Begin, r.End, r.Global.TotalQueries})
+	}
+	expect := [][]interface{}{
+		{ts("2017-01-01T00:00:01"), ts("2017-01-01T00:01:00"), uint(3)},
+		{ts("2017-01-01T00:01:00"), ts("2017-01-01T00:02:00"), uint(4)},
+	}
+	if len(got) < 2 {
+		t.Fatalf("got %d buckets, expected at least 2", len(got))
+	}
+	if diff := deep.Equal(got[:2], expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qdelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "slow.log")
+
+	event := func(ts, query string) string {
+		return "# Time: " + ts + "\n# User@Host: root[root] @ localhost []\n" +
+			"# Query_time: 1  Lock_time: 0  Rows_sent: 1  Rows_examined: 0\n" + query + ";\n"
+	}
+	write := func(flag int, data string) {
+		fd, err := os.OpenFile(file, flag|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		if _, err := fd.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(f *slowlog.Follower) string {
+		select {
+		case e := <-f.Events():
+			return e.Query
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+		return ""
+	}
+
+	// Events already in the file are not followed
+	write(os.O_CREATE, event("170101 00:00:00", "select 1"))
+	f := slowlog.NewFollower(file, 10*time.Millisecond)
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	write(os.O_APPEND, event("170101 00:00:01", "select 2")+event("170101 00:00:02", "select 3"))
+	got := []string{recv(f), recv(f)}
+
+	// Rotate
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write(os.O_CREATE, event("170101 00:00:03", "select 4"))
+	got = append(got, recv(f))
+
+	// Truncate, which is only detected if the file is smaller than before
+	write(os.O_TRUNC, event("170101 00:00:04", "do 5"))
+	got = append(got, recv(f))
+
+	expect := []string{"select 2;", "select 3;", "select 4;", "do 5;"}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestProcessFilter(t *testing.T) {
+	re := func(s string) *regexp.Regexp {
+		r, err := slowlog.FilterRegexp(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	tests := []struct {
+		filter slowlog.Filter
+		expect uint
+	}{
+		{slowlog.Filter{}, 7},
+		{slowlog.Filter{User: re("app")}, 4},
+		{slowlog.Filter{User: re("app|report")}, 6},
+		{slowlog.Filter{User: re("ap")}, 0}, // whole value
+		{slowlog.Filter{Host: re(`web\d+`), Db: re("shop")}, 3},
+		{slowlog.Filter{IgnoreUser: re("root"), IgnoreDb: re("stats")}, 4},
+	}
+	for i, test := range tests {
+		p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+		p.Filter = test.filter
+		res, err := p.Process("../test/slowlogs/slow9003-users.log", []slowlog.Interval{{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Global.TotalQueries != test.expect {
+			t.Errorf("filter %d: got %d queries, expected %d", i, res[0].Global.TotalQueries, test.expect)
+		}
+	}
+	if _, err := slowlog.FilterRegexp("("); err == nil {
+		t.Error("no error for invalid regex")
+	}
+}
+
+func TestProcessGroupBy(t *testing.T) {
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	p.GroupBy = "user"
+	res, err := p.Process("../test/slowlogs/slow9003-users.log", []slowlog.Interval{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Class ID is query ID@user, so each query is broken down by user
+	got := map[string]uint{}
+	for id, class := range res[0].Class {
+		at := strings.Index(id, "@")
+		if at < 0 {
+			t.Fatalf("class ID %s does not have @user", id)
+		}
+		got[class.Fingerprint+id[at:]] = class.TotalQueries
+	}
+	fpC := query.Fingerprint("select c from t where id=1")
+	fpS := query.Fingerprint("select count(*) from s")
+	expect := map[string]uint{
+		fpC + "@app":    3,
+		fpC + "@report": 1,
+		fpC + "@root":   1,
+		fpS + "@report": 1,
+		fpS + "@app":    1,
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestProcessISOTs(t *testing.T) {
+	// MySQL 5.7+ ts like 2017-01-01T00:00:00.123456Z, with microseconds
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	i, err := slowlog.ParseInterval("2017-01-01T00:00:00/2017-01-01T00:59:59.999999", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.Process("../test/slowlogs/slow9004-iso.log", []slowlog.Interval{i, {Since: ts("2017-01-01T01:00:00")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := [][]interface{}{}
+	for _, r := range res {
+		got = append(got, []interface{}{r.Begin, r.End, r.Global.TotalQueries})
+	}
+	expect := [][]interface{}{
+		{time.Date(2017, 1, 1, 0, 0, 0, 123456000, time.UTC), time.Date(2017, 1, 1, 0, 59, 59, 999999000, time.UTC), uint(3)},
+		{time.Date(2017, 1, 1, 1, 0, 0, 1000, time.UTC), time.Date(2017, 1, 1, 1, 30, 0, 250000000, time.UTC), uint(2)},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestProcessTimeZone(t *testing.T) {
+	// Old ts format is server time zone, with a space-padded hour like
+	// "170101  9:00:00". Ranges and results are in the same time zone.
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	p.Location = loc
+	i, err := slowlog.ParseInterval("2017-01-01T09:15:00/2017-01-01T10:00:00", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.Process("../test/slowlogs/slow9005-tz.log", []slowlog.Interval{i})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{res[0].Begin.String(), res[0].End.UTC(), res[0].Global.TotalQueries}
+	expect := []interface{}{"2017-01-01 09:30:00 -0500 EST", ts("2017-01-01T15:00:00"), uint(2)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+}
+
+func TestProcessDST(t *testing.T) {
+	// DST starts at 2:00 (EST -0500 to EDT -0400), so example timestamps
+	// are converted to UTC with a different offset before and after
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	p.Location = loc
+	res, err := p.Process("../test/slowlogs/slow9008-dst.log", []slowlog.Interval{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"select a": "06:30:00", // 1:30 EST
+		"select b": "07:30:00", // 3:30 EDT
+	}
+	for _, class := range res[0].Class {
+		for query, utc := range expect {
+			if strings.HasPrefix(class.Example.Query, query) && !strings.HasSuffix(class.Example.Ts, utc) {
+				t.Errorf("%s: got example ts %s, expected %s UTC", query, class.Example.Ts, utc)
+			}
+		}
+	}
+}
+
+func TestProcessSampleRate(t *testing.T) {
+	// The first minute isn't sampled, then the second minute is
+	// Log_slow_rate_limit 10 except an outlier which is always logged
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	intervals := []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:00:59")},
+		{Since: ts("2017-01-01T00:01:00"), Until: ts("2017-01-01T00:01:59")},
+	}
+	res, err := p.Process("../test/slowlogs/slow9006-sampled.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{
+		res[0].Global.TotalQueries, res[0].SampleRate, res[0].Rate(),
+		res[1].Global.TotalQueries, res[1].SampleRate, res[1].Rate(),
+	}
+	expect := []interface{}{
+		uint(10), 0.0, 1.0,
+		uint(2), 5.5, 5.5, // (10 + 1) / 2
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		for _, d := range diff {
+			t.Error(d)
+		}
+	}
+
+	// Each class has its own rate: the outlier is another query that isn't
+	// sampled, so it's only itself
+	rates := map[string]float64{}
+	for id, class := range res[1].Class {
+		rates[class.Fingerprint] = res[1].ClassRate(id)
+	}
+	expectRates := map[string]float64{
+		"select c from t where id=?": 10,
+		"select d from t where id=?": 1,
+	}
+	if diff := deep.Equal(rates, expectRates); diff != nil {
+		t.Error(diff)
+	}
+
+	// Combined rate is weighted by events: (10*1 + 2*5.5) / 12, and class c
+	// rate is (10*1 + 1*10) / 11
+	c := slowlog.Combine(res...)
+	if diff := deep.Equal(c.SampleRate, 21.0/12); diff != nil {
+		t.Error(diff)
+	}
+	rates = map[string]float64{}
+	for id, class := range c.Class {
+		rates[class.Fingerprint] = c.ClassRate(id)
+	}
+	expectRates = map[string]float64{
+		"select c from t where id=?": 20.0 / 11,
+		"select d from t where id=?": 1,
+	}
+	if diff := deep.Equal(rates, expectRates); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestProcessFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qdelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Split slow9001.log at "# Time:" lines into a rotated gzip, zstd, and
+	// plain file, like slow.log.2.gz slow.log.1.zst slow.log
+	bytes, err := ioutil.ReadFile("../test/slowlogs/slow9001.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(bytes)
+	split1 := strings.Index(log, "# Time: 170101 00:01:00")
+	split2 := strings.Index(log, "# Time: 170101 00:03:00")
+	write := func(name string, data string, compress func(io.Writer) io.WriteCloser) string {
+		file := filepath.Join(dir, name)
+		fd, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		w := compress(fd)
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	gz := write("slow.log.2.gz", log[:split1], func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	zst := write("slow.log.1.zst", log[split1:split2], func(w io.Writer) io.WriteCloser {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zw
+	})
+	plain := write("slow.log", log[split2:], func(w io.Writer) io.WriteCloser { return nopCloser{w} })
+
+	// Files in any order are one continuous slow log in time order
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	intervals := []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:00:59")},
+		{Since: ts("2017-01-01T00:01:00"), Until: ts("2017-01-01T00:03:59")},
+	}
+	res, err := p.ProcessFiles([]string{plain, gz, zst}, intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := p.Process("../test/slowlogs/slow9001.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range res {
+		got := []interface{}{res[i].Begin, res[i].End, res[i].Global.TotalQueries}
+		exp := []interface{}{expect[i].Begin, expect[i].End, expect[i].Global.TotalQueries}
+		if diff := deep.Equal(got, exp); diff != nil {
+			t.Errorf("interval %d: %s", i, diff)
+		}
+	}
+
+	// One compressed file, even without an extension
+	if err := os.Rename(gz, filepath.Join(dir, "gz")); err != nil {
+		t.Fatal(err)
+	}
+	res, err = p.Process(filepath.Join(dir, "gz"), []slowlog.Interval{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Global.TotalQueries != 4 {
+		t.Errorf("got %d queries, expected 4", res[0].Global.TotalQueries)
+	}
+
+	// A corrupt compressed file is an error, not partial results
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.gz"), []byte("\x1f\x8bnot gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Process(filepath.Join(dir, "bad.gz"), []slowlog.Interval{{}}); err == nil {
+		t.Error("no error for corrupt gzip")
+	}
+}
+
+// eventParser is a parser of events, like a pcap parser with events out of
+// ts order.
+type eventParser struct {
+	events chan gomysql.Event
+}
+
+func newEventParser(events ...gomysql.Event) *eventParser {
+	p := &eventParser{events: make(chan gomysql.Event, len(events))}
+	for _, e := range events {
+		p.events <- e
+	}
+	close(p.events)
+	return p
+}
+
+func (p *eventParser) Start(gomysql.Options) error  { return nil }
+func (p *eventParser) Events() <-chan gomysql.Event { return p.events }
+func (p *eventParser) Stop()                        {}
+func (p *eventParser) Error() error                 { return nil }
+
+func TestProcessUnordered(t *testing.T) {
+	// The 00:00:01 event is after the 00:00:05 event, which is after until
+	events := []gomysql.Event{
+		{Ts: "2017-01-01T00:00:02.000000Z", Query: "select 2", TimeMetrics: map[string]float64{"Query_time": 1}},
+		{Ts: "2017-01-01T00:00:05.000000Z", Query: "select 5", TimeMetrics: map[string]float64{"Query_time": 1}},
+		{Ts: "2017-01-01T00:00:01.000000Z", Query: "select 1", TimeMetrics: map[string]float64{"Query_time": 1}},
+	}
+	intervals := []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:00:03")},
+	}
+
+	// In order, the interval ends at the 00:00:05 event
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	p.NewParser = func(*os.File) gomysql.Parser { return newEventParser(events...) }
+	res, err := p.Process("../test/slowlogs/slow9001.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries}
+	expect := []interface{}{ts("2017-01-01T00:00:02"), ts("2017-01-01T00:00:02"), uint(1)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	p.Unordered = true
+	res, err = p.Process("../test/slowlogs/slow9001.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries}
+	expect = []interface{}{ts("2017-01-01T00:00:01"), ts("2017-01-01T00:00:02"), uint(2)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestProcessParser(t *testing.T) {
+	// General log: MySQL 5.6 ts only when it changes, no Query_time
+	p := slowlog.NewProcessor(time.Duration(0), 10, 2)
+	p.NewParser = func(fd *os.File) gomysql.Parser { return genlog.NewParser(fd) }
+	intervals := []slowlog.Interval{
+		{Since: ts("2017-01-01T00:00:00"), Until: ts("2017-01-01T00:00:01")},
+	}
+	res, err := p.Process("../test/genlogs/general-5.6.log", intervals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries}
+	expect := []interface{}{ts("2017-01-01T00:00:00"), ts("2017-01-01T00:00:01"), uint(3)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// pcap: Query_time is response time
+	p.NewParser = func(fd *os.File) gomysql.Parser { return pcap.NewParser(fd, pcap.DEFAULT_PORT) }
+	p.Unordered = true
+	res, err = p.Process("../test/pcaps/mysql.pcap", []slowlog.Interval{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = []interface{}{res[0].Begin, res[0].End, res[0].Global.TotalQueries, res[0].Global.UniqueQueries}
+	expect = []interface{}{ts("2017-01-01T00:00:01"), ts("2017-01-01T00:00:04.5"), uint(5), uint(4)}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,86 @@
+package slowlog
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-mysql/slowlog"
+)
+
+// Stream aggregates a never-ending stream of events (see Follower) into
+// consecutive buckets. Buckets are aligned to the bucket duration. Each
+// bucket's result is sent on the returned channel when the first event after
+// the bucket is received, so a bucket is not sent until the slow log has a
+// newer event. Unlike Process, result Begin and End are the bucket bounds,
+// not the first and last events, so QPS is correct for quiet buckets. The
+// first bucket begins at the first event, though, because events usually
+// start partway through it, e.g. when following a slow log. The returned
+// channel is closed when events is closed; the last bucket is not sent
+// because it's incomplete.
+func (p *Processor) Stream(events <-chan slowlog.Event, bucket time.Duration) <-chan Result {
+	resChan := make(chan Result, 1)
+	go func() {
+		defer close(resChan)
+
+		var (
+			a      *slowlog.Aggregator
+			begin  time.Time // of current bucket, aligned to bucket
+			first  time.Time // of first event, if in current bucket
+			lastTs time.Time // see Process
+			r      rates     // of current bucket
+		)
+		for event := range events {
+			if event.Ts == "" {
+				if lastTs.IsZero() {
+					continue // keep looking for known start ts
+				}
+			} else {
+				ts, err := parseTs(event.Ts, p.location())
+				if err != nil {
+					log.Printf("invalid slow log timestamp (recovering): %s: %s", event.Ts, err)
+					continue
+				}
+				lastTs = ts
+				event.Ts = utcTs(ts)
+			}
+
+			if a == nil {
+				begin = lastTs.Truncate(bucket)
+				first = lastTs
+				a = slowlog.NewAggregator(true, p.utcOffset, p.outlierTime)
+			}
+
+			// Send every bucket before this event, even if empty
+			for !lastTs.Before(begin.Add(bucket)) {
+				b := begin
+				if !first.IsZero() {
+					b = first // partial first bucket
+					first = time.Time{}
+				}
+				resChan <- Result{
+					Begin:           b,
+					End:             begin.Add(bucket),
+					Result:          a.Finalize(),
+					SampleRate:      r.rate(),
+					ClassSampleRate: r.classRates(),
+				}
+				begin = begin.Add(bucket)
+				a = slowlog.NewAggregator(true, p.utcOffset, p.outlierTime)
+				r = rates{}
+			}
+
+			if !p.Filter.Match(event) {
+				continue
+			}
+			f, crash := fingerprint(event.Query)
+			if crash != nil {
+				log.Printf("fingerprinter crashed (recovering): %s: %s", crash, event.Query)
+				continue
+			}
+			id := p.classId(f, event)
+			r.add(id, 1, p.sampleRate(&event))
+			a.AddEvent(event, id, f)
+		}
+	}()
+	return resChan
+}